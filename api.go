@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"chat/auth"
+	"chat/models"
+	"chat/presence"
+	"chat/repository"
+
+	"github.com/google/uuid"
+)
+
+// Maximum number of messages returned per history page
+const maxHistoryPageSize = 100
+
+// API serves the plain http endpoints next to the websocket
+type API struct {
+	AccountRepository models.AccountRepository
+	RoomRepository    models.RoomRepository
+	Presence          presence.Store
+	MessageRepository models.MessageRepository
+	WsServer          *WsServer
+}
+
+// Credentials posted to login and register endpoints
+type Credentials struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// TokenResponse is returned after successful login or registration
+type TokenResponse struct {
+	Token string      `json:"token"`
+	User  models.User `json:"user"`
+}
+
+// StatsResponse describes the state of this node
+type StatsResponse struct {
+	LoadedRooms int64          `json:"loadedRooms"`
+	SendQueues  SendQueueStats `json:"sendQueues"`
+}
+
+// RoomResponse is returned for room details
+type RoomResponse struct {
+	Room    models.Room   `json:"room"`
+	Members []models.User `json:"members"`
+}
+
+// HandleLogin checks credentials and returns a signed token
+func (api *API) HandleLogin(w http.ResponseWriter, r *http.Request) {
+
+	credentials, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	account, err := api.AccountRepository.FindAccountByUsername(r.Context(), credentials.Username)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	if account == nil || !auth.CheckPassword(account.GetPassword(), credentials.Password) {
+		http.Error(w, "invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	writeToken(w, &repository.User{ID: account.GetID(), Name: account.GetName()})
+}
+
+// HandleRegister creates a new account and returns a signed token
+func (api *API) HandleRegister(w http.ResponseWriter, r *http.Request) {
+
+	credentials, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	existing, err := api.AccountRepository.FindAccountByUsername(r.Context(), credentials.Username)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	if existing != nil {
+		http.Error(w, "username is already taken", http.StatusConflict)
+		return
+	}
+
+	hash, err := auth.HashPassword(credentials.Password)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	name := credentials.Name
+	if name == "" {
+		name = credentials.Username
+	}
+
+	account := &repository.Account{
+		ID:       uuid.New().String(),
+		Name:     name,
+		Username: credentials.Username,
+		Password: hash,
+	}
+	if err := api.AccountRepository.AddAccount(r.Context(), account); err != nil {
+		internalError(w, err)
+		return
+	}
+
+	writeToken(w, &repository.User{ID: account.GetID(), Name: account.GetName()})
+}
+
+// HandleRooms lists public rooms
+func (api *API) HandleRooms(w http.ResponseWriter, r *http.Request, user models.User) {
+
+	rooms, err := api.RoomRepository.GetPublicRooms(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	writeJSON(w, rooms)
+}
+
+// HandleRoom serves /api/rooms/{id} with room details and members
+// and /api/rooms/{id}/messages with a page of room history
+func (api *API) HandleRoom(w http.ResponseWriter, r *http.Request, user models.User) {
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/rooms/"), "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "messages") {
+		http.NotFound(w, r)
+		return
+	}
+
+	room, ok := api.findAccessibleRoom(w, r, parts[0], user)
+	if !ok {
+		return
+	}
+
+	if len(parts) == 2 {
+		api.writeRoomMessages(w, r, room)
+		return
+	}
+
+	members, err := api.RoomRepository.GetRoomMembers(r.Context(), room.GetID())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	writeJSON(w, &RoomResponse{Room: room, Members: members})
+}
+
+// HandleOnlineUsers lists users currently connected to any node
+func (api *API) HandleOnlineUsers(w http.ResponseWriter, r *http.Request, user models.User) {
+
+	users, err := api.Presence.Online(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	writeJSON(w, users)
+}
+
+// HandleStats reports the state of this node
+func (api *API) HandleStats(w http.ResponseWriter, r *http.Request, user models.User) {
+	writeJSON(w, &StatsResponse{
+		LoadedRooms: api.WsServer.LoadedRooms(),
+		SendQueues:  GetSendQueueStats(),
+	})
+}
+
+// Authenticated wraps handlers which need the user behind the bearer token
+func (api *API) Authenticated(handler func(http.ResponseWriter, *http.Request, models.User)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, err := auth.ValidateToken(tokenFromRequest(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r, user)
+	}
+}
+
+// Private rooms are only visible to their members, to anyone else they don't exist
+func (api *API) findAccessibleRoom(w http.ResponseWriter, r *http.Request, roomID string, user models.User) (models.Room, bool) {
+
+	room, err := api.RoomRepository.FindRoomByID(r.Context(), roomID)
+	if err != nil {
+		internalError(w, err)
+		return nil, false
+	}
+
+	if room != nil && room.GetPrivate() {
+		member, err := api.RoomRepository.IsRoomMember(r.Context(), room.GetID(), user.GetID())
+		if err != nil {
+			internalError(w, err)
+			return nil, false
+		}
+		if !member {
+			room = nil
+		}
+	}
+
+	if room == nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	return room, true
+}
+
+// Pages back through history with the 'before' message id and 'limit' url params
+func (api *API) writeRoomMessages(w http.ResponseWriter, r *http.Request, room models.Room) {
+
+	limit := roomHistoryLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	if limit > maxHistoryPageSize {
+		limit = maxHistoryPageSize
+	}
+
+	messages, err := api.MessageRepository.GetRoomMessages(r.Context(), room.GetID(), r.URL.Query().Get("before"), limit)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	writeJSON(w, messages)
+}
+
+func readCredentials(w http.ResponseWriter, r *http.Request) (*Credentials, bool) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	var credentials Credentials
+	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+		http.Error(w, "malformed request body", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if credentials.Username == "" || credentials.Password == "" {
+		http.Error(w, "username and password are required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return &credentials, true
+}
+
+func writeToken(w http.ResponseWriter, user models.User) {
+
+	token, err := auth.CreateToken(user)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	writeJSON(w, &TokenResponse{Token: token, User: user})
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println(err)
+	}
+}
+
+// Logs the error and hides its details from the caller
+func internalError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"chat/models"
+)
+
+// TokenTTL is the lifetime of issued tokens
+const TokenTTL = 24 * time.Hour
+
+var (
+	// ErrInvalidToken is returned for malformed tokens or tokens with a bad signature
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpiredToken is returned for tokens past their expiry time
+	ErrExpiredToken = errors.New("token expired")
+)
+
+var secret []byte
+
+// SetSecret sets the key used to sign and verify tokens
+func SetSecret(key []byte) {
+	secret = key
+}
+
+// Claims is the verified identity carried by a token
+type Claims struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// GetID returns id of the authenticated user
+func (claims *Claims) GetID() string {
+	return claims.ID
+}
+
+// GetName returns name of the authenticated user
+func (claims *Claims) GetName() string {
+	return claims.Name
+}
+
+// CreateToken creates a signed token for the given user
+func CreateToken(user models.User) (string, error) {
+
+	claims := &Claims{
+		ID:        user.GetID(),
+		Name:      user.GetName(),
+		ExpiresAt: time.Now().Add(TokenTTL).Unix(),
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	signature := base64.RawURLEncoding.EncodeToString(sign(encodedPayload))
+
+	return encodedPayload + "." + signature, nil
+}
+
+// ValidateToken checks token signature and expiry and returns the user it was issued to
+func ValidateToken(token string) (models.User, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, sign(parts[0])) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if time.Now().Unix() > claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
+
+func sign(payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -2,52 +2,126 @@ package main
 
 import (
 	"chat/config"
+	"chat/metrics"
 	"chat/models"
+	"chat/presence"
+	"chat/pubsub"
+	"chat/session"
+	"context"
 	"encoding/json"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
 // PubSubGeneralChannel ...
 const PubSubGeneralChannel = "general"
 
+// ServerOptions tune the websocket server
+type ServerOptions struct {
+	// Rooms without clients are unloaded after this period, zero keeps them loaded
+	RoomIdleTimeout time.Duration
+	// Timings and limits of client connections
+	Websocket config.WebsocketConfig
+	// What to do with messages for clients whose queue is full
+	SlowConsumerPolicy SlowConsumerPolicy
+	// Connections not refreshed for this long are offline
+	PresenceTTL time.Duration
+	// Interval of refreshing the presence of local connections
+	HeartbeatInterval time.Duration
+	// How long a dropped connection may be resumed, zero disables resuming
+	SessionGracePeriod time.Duration
+}
+
 // WsServer structure for client web sockets connections
 type WsServer struct {
-	clients    map[*Client]bool
-	rooms      map[*Room]bool
+	registry   *registry
 	register   chan *Client
 	unregister chan *Client
-	broadcast  chan []byte
-
-	users          []models.User
-	roomRepository models.RoomRepository
-	userRepository models.UserRepository
+	broadcast  chan *Message
+	unloadRoom chan *Room
+	quit       chan struct{}
+	quitOnce   sync.Once
+	done       chan struct{}
+	draining   int32
+
+	options  ServerOptions
+	upgrader websocket.Upgrader
+
+	subscription      pubsub.Subscription
+	pubSub            pubsub.PubSub
+	presence          presence.Store
+	sessions          session.Store
+	roomRepository    models.RoomRepository
+	messageRepository models.MessageRepository
+	accountRepository models.AccountRepository
 }
 
 // NewWebsocketServer creates a new WsServer type
-func NewWebsocketServer(roomRepository models.RoomRepository, userRepository models.UserRepository) *WsServer {
+func NewWebsocketServer(
+	options ServerOptions,
+	pubSub pubsub.PubSub,
+	presence presence.Store,
+	sessions session.Store,
+	roomRepository models.RoomRepository,
+	messageRepository models.MessageRepository,
+	accountRepository models.AccountRepository,
+) (*WsServer, error) {
 
 	wsServer := &WsServer{
-		clients:        make(map[*Client]bool),
-		rooms:          make(map[*Room]bool),
-		register:       make(chan *Client),
-		unregister:     make(chan *Client),
-		broadcast:      make(chan []byte),
-		roomRepository: roomRepository,
-		userRepository: userRepository,
+		registry:   newRegistry(),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan *Message),
+		unloadRoom: make(chan *Room),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		options:    options,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  options.Websocket.ReadBufferSize,
+			WriteBufferSize: options.Websocket.WriteBufferSize,
+		},
+		pubSub:            pubSub,
+		presence:          presence,
+		sessions:          sessions,
+		roomRepository:    roomRepository,
+		messageRepository: messageRepository,
+		accountRepository: accountRepository,
 	}
 
-	// Add users from database to server
-	wsServer.users = userRepository.GetAllUsers()
-
-	return wsServer
+	return wsServer, nil
 }
 
-// Run our websocket server, accepting various requests
+// Run our websocket server, accepting various requests until shut down
 func (server *WsServer) Run() {
 
-	go server.listenPubSubChannel()
+	defer close(server.done)
+
+	subscription, err := server.pubSub.Subscribe(ctx, PubSubGeneralChannel)
+	if err != nil {
+		log.Printf("Error on subscribing to general channel %s", err)
+	} else {
+		server.subscription = subscription
+		go server.listenPubSubChannel(subscription)
+	}
+
+	// Snapshot after subscribing, so no user-join or user-left falls in between
+	users, err := server.presence.Online(ctx)
+	if err != nil {
+		log.Printf("Error on loading online users %s", err)
+	}
+	for _, user := range users {
+		server.registry.addUser(user)
+	}
+
+	go server.keepPresence()
+
 	for {
 		select {
 
@@ -58,119 +132,301 @@ func (server *WsServer) Run() {
 			server.unregisterClient(client)
 
 		case message := <-server.broadcast:
-			server.broadcastToClients(message)
+			server.broadcastToClients(message.Action, message.encode())
+
+		case room := <-server.unloadRoom:
+			server.removeRoom(room)
+
+		case <-server.quit:
+			server.stop()
+			return
 		}
 
 	}
 }
 
-func (server *WsServer) findRoomByName(name string) *Room {
+// Shutdown stops accepting new connections, closes the existing ones
+// and stops all rooms. It returns when done or when ctx expires.
+func (server *WsServer) Shutdown(ctx context.Context) error {
+
+	server.StartDraining()
+	server.quitOnce.Do(func() { close(server.quit) })
+
+	select {
+	case <-server.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StartDraining rejects new connections and reports the node unready,
+// existing connections stay open until Shutdown
+func (server *WsServer) StartDraining() {
+	atomic.StoreInt32(&server.draining, 1)
+}
+
+// Draining returns true once the server started shutting down
+func (server *WsServer) Draining() bool {
+	return atomic.LoadInt32(&server.draining) == 1
+}
+
+func (server *WsServer) stop() {
 
-	var foundRoom *Room
-	for room := range server.rooms {
-		if room.GetName() == name {
-			foundRoom = room
-			break
+	for _, client := range server.registry.clientList() {
+		// Unregister first, so other nodes see the user leave right away
+		server.unregisterClient(client)
+		client.close(websocket.CloseServiceRestart, "server restarting")
+	}
+
+	for _, room := range server.registry.roomList() {
+		room.Stop()
+		server.removeRoom(room)
+	}
+
+	if server.subscription != nil {
+		if err := server.subscription.Unsubscribe(); err != nil {
+			log.Println(err)
 		}
 	}
+}
+
+func (server *WsServer) findRoomByName(name string) (*Room, error) {
 
-	if foundRoom == nil {
-		foundRoom = server.runRoomFromRepository(name)
+	if room := server.registry.findRoomByName(name); room != nil {
+		return room, nil
 	}
 
-	return foundRoom
+	return server.runRoomFromRepository(name)
 }
 
-func (server *WsServer) runRoomFromRepository(name string) *Room {
+func (server *WsServer) runRoomFromRepository(name string) (*Room, error) {
 
-	var room *Room
-	dbRoom := server.roomRepository.FindRoomByName(name)
+	dbRoom, err := server.roomRepository.FindRoomByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
 
-	if dbRoom != nil {
-		room = NewRoom(dbRoom.GetName(), dbRoom.GetPrivate())
-		room.ID, _ = uuid.Parse(dbRoom.GetID())
-		go room.RunRoom()
+	return server.runRoom(dbRoom), nil
+}
+
+// Starts a room loaded from the repository, returns nil for a nil room
+func (server *WsServer) runRoom(dbRoom models.Room) *Room {
 
-		server.rooms[room] = true
+	if dbRoom == nil {
+		return nil
 	}
 
-	return room
+	room := NewRoom(dbRoom.GetName(), dbRoom.GetPrivate(), server.pubSub)
+	room.ID, _ = uuid.Parse(dbRoom.GetID())
+
+	return server.startRoom(room)
 }
 
-func (server *WsServer) findRoomByID(ID string) *Room {
+// Runs the room and keeps it loaded until it stops itself after being idle.
+// Another goroutine may have loaded the same room meanwhile, then that one is returned.
+func (server *WsServer) startRoom(room *Room) *Room {
 
-	var foundRoom *Room
-	for room := range server.rooms {
-		if room.GetID() == ID {
-			foundRoom = room
-			break
+	room.idleTimeout = server.options.RoomIdleTimeout
+	loaded, added := server.registry.addRoom(room)
+	if !added {
+		return loaded
+	}
+	metrics.LoadedRooms.Inc()
+
+	go func() {
+		room.RunRoom()
+		select {
+		case server.unloadRoom <- room:
+		case <-server.done:
 		}
+	}()
+
+	return room
+}
+
+func (server *WsServer) removeRoom(room *Room) {
+	if server.registry.removeRoom(room) {
+		metrics.LoadedRooms.Dec()
 	}
+}
 
-	return foundRoom
+// LoadedRooms returns the number of rooms currently running on this node
+func (server *WsServer) LoadedRooms() int64 {
+	return int64(server.registry.roomCount())
 }
 
-func (server *WsServer) findClientByID(ID string) *Client {
+// Rooms may live on another node or not be loaded yet, so fall back to the repository
+func (server *WsServer) findRoomByID(ID string) (*Room, error) {
 
-	var foundClient *Client
-	for client := range server.clients {
-		if client.GetID() == ID {
-			foundClient = client
-			break
-		}
+	if room := server.registry.findRoomByID(ID); room != nil {
+		return room, nil
+	}
+
+	dbRoom, err := server.roomRepository.FindRoomByID(ctx, ID)
+	if err != nil {
+		return nil, err
 	}
 
-	return foundClient
+	return server.runRoom(dbRoom), nil
+}
+
+func (server *WsServer) findClientsByID(ID string) []*Client {
+
+	return server.registry.findClientsByID(ID)
 }
 
 func (server *WsServer) registerClient(client *Client) {
 
-	// Add user to the repo
-	server.userRepository.AddUser(client)
+	first, err := server.presence.Connect(ctx, client.connectionID, client, server.options.PresenceTTL)
+	if err != nil {
+		log.Printf("Error on adding user %s: %s", client.GetID(), err)
+		client.sendError("", ErrorCodeInternal, "could not register user")
+	}
 
-	// Publish user in pubsub
-	server.publishClientJoined(client)
+	// Other devices of the user already announced it
+	if first {
+		server.publishClientJoined(client)
+	}
 
 	server.listOnlineClients(client)
-	server.clients[client] = true
+	server.sendPendingInvitations(client)
+	server.registry.addClient(client)
+	metrics.ConnectedClients.Inc()
 }
 
 func (server *WsServer) unregisterClient(client *Client) {
 
-	if _, ok := server.clients[client]; ok {
+	if server.registry.removeClient(client) {
+		metrics.ConnectedClients.Dec()
+
+		last, err := server.presence.Disconnect(ctx, client.connectionID)
+		if err != nil {
+			log.Printf("Error on removing user %s: %s", client.GetID(), err)
+		}
+
+		// The user stays online while another of its connections is live
+		if last {
+			server.publishClientLeft(client)
+		}
+	}
+}
 
-		delete(server.clients, client)
+// Refreshes the presence of local connections and expires the connections
+// of nodes which stopped refreshing them, e.g. after a crash
+func (server *WsServer) keepPresence() {
 
-		for i, user := range server.users {
-			if user.GetID() == client.GetID() {
-				server.users[i] = server.users[len(server.users)-1]
-				server.users = server.users[:len(server.users)-1]
+	ticker := time.NewTicker(server.options.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			clients := server.registry.clientList()
+			connectionIDs := make([]string, 0, len(clients))
+			for _, client := range clients {
+				connectionIDs = append(connectionIDs, client.connectionID)
 			}
+			if err := server.presence.Refresh(ctx, connectionIDs, server.options.PresenceTTL); err != nil {
+				log.Printf("Error on refreshing presence %s", err)
+			}
+
+			left, err := server.presence.Expire(ctx)
+			if err != nil {
+				log.Printf("Error on expiring presence %s", err)
+			}
+			for _, user := range left {
+				server.publishClientLeft(user)
+			}
+
+		case <-server.quit:
+			return
 		}
+	}
+}
 
-		// Remove user from repo
-		server.userRepository.RemoveUser(client)
+func (server *WsServer) broadcastToClients(action string, message []byte) {
+	clients := server.registry.clientList()
+	metrics.MessagesSent.WithLabelValues(action).Add(float64(len(clients)))
+	for _, client := range clients {
+		client.enqueue(message)
+	}
+}
 
-		// Publish user left in PubSub
-		server.publishClientLeft(client)
+func (server *WsServer) createRoom(name string, private bool) (*Room, error) {
+
+	room := NewRoom(name, private, server.pubSub)
+	if err := server.roomRepository.AddRoom(ctx, room); err != nil {
+		return nil, err
 	}
+
+	return server.startRoom(room), nil
 }
 
-func (server *WsServer) broadcastToClients(message []byte) {
-	for client := range server.clients {
-		client.send <- message
+// Direct rooms are identified by the sorted pair of their members' IDs,
+// so both users always resolve to the same room
+func directRoomName(userID string, otherUserID string) string {
+
+	ids := []string{userID, otherUserID}
+	sort.Strings(ids)
+
+	return strings.Join(ids, ":")
+}
+
+// isDirectRoomName reports whether name has the form of a direct room name,
+// such names are reserved so nobody can take the room of two other users
+func isDirectRoomName(name string) bool {
+
+	ids := strings.Split(name, ":")
+	if len(ids) != 2 {
+		return false
 	}
+
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return false
+		}
+	}
+
+	return true
 }
 
-func (server *WsServer) createRoom(name string, private bool) *Room {
+// Finds the direct room of two users, or creates it, with both users as its only members
+func (server *WsServer) findOrCreateDirectRoom(user models.User, otherUser models.User) (*Room, error) {
+
+	name := directRoomName(user.GetID(), otherUser.GetID())
 
-	room := NewRoom(name, private)
-	server.roomRepository.AddRoom(room)
+	room, err := server.findRoomByName(name)
+	if err != nil {
+		return nil, err
+	}
 
-	go room.RunRoom()
-	server.rooms[room] = true
+	// Only a private room is the direct room, anything else took its name
+	if room != nil && !room.Private {
+		return nil, errRoomNameReserved
+	}
 
-	return room
+	if room == nil {
+		room, err = server.createRoom(name, true)
+		if err != nil {
+			// The room may have been created by another node in the meantime
+			existing, findErr := server.findRoomByName(name)
+			if findErr != nil || existing == nil || !existing.Private {
+				return nil, err
+			}
+			room = existing
+		}
+	}
+
+	// Members are added on every call, adding them again is a no-op, so a
+	// room left without members by a failed earlier call is repaired here
+	for _, member := range []models.User{user, otherUser} {
+		if err := server.roomRepository.AddRoomMember(ctx, room.GetID(), member.GetID(), models.RoleMember); err != nil {
+			return nil, err
+		}
+	}
+
+	return room, nil
 }
 
 func (server *WsServer) notifyClientJoined(client *Client) {
@@ -180,7 +436,7 @@ func (server *WsServer) notifyClientJoined(client *Client) {
 		Sender: client,
 	}
 
-	server.broadcastToClients(message.encode())
+	server.broadcastToClients(message.Action, message.encode())
 }
 
 func (server *WsServer) notifyClientLeft(client *Client) {
@@ -190,17 +446,17 @@ func (server *WsServer) notifyClientLeft(client *Client) {
 		Sender: client,
 	}
 
-	server.broadcastToClients(message.encode())
+	server.broadcastToClients(message.Action, message.encode())
 }
 
 func (server *WsServer) listOnlineClients(client *Client) {
 
-	for _, user := range server.users {
+	for _, user := range server.registry.userList() {
 		message := &Message{
 			Action: UserJoinedAction,
 			Sender: user,
 		}
-		client.send <- message.encode()
+		client.sendMessage(message)
 	}
 }
 
@@ -211,32 +467,29 @@ func (server *WsServer) publishClientJoined(client *Client) {
 		Sender: client,
 	}
 
-	if err := config.Redis.Publish(ctx, PubSubGeneralChannel, message.encode()).Err(); err != nil {
+	if err := server.pubSub.Publish(ctx, PubSubGeneralChannel, message.encode()); err != nil {
 		log.Println(err)
 	}
 }
 
-func (server *WsServer) publishClientLeft(client *Client) {
+func (server *WsServer) publishClientLeft(user models.User) {
 
 	message := &Message{
 		Action: UserLeftAction,
-		Sender: client,
+		Sender: user,
 	}
 
-	if err := config.Redis.Publish(ctx, PubSubGeneralChannel, message.encode()).Err(); err != nil {
+	if err := server.pubSub.Publish(ctx, PubSubGeneralChannel, message.encode()); err != nil {
 		log.Println(err)
 	}
 }
 
 // Listen to pub/sub general channels
-func (server *WsServer) listenPubSubChannel() {
+func (server *WsServer) listenPubSubChannel(subscription pubsub.Subscription) {
 
-	pubSub := config.Redis.Subscribe(ctx, PubSubGeneralChannel)
-	ch := pubSub.Channel()
-
-	for msg := range ch {
+	for payload := range subscription.Channel() {
 		var message Message
-		if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
+		if err := json.Unmarshal(payload, &message); err != nil {
 			log.Printf("Error on unmarshal json message %s", err)
 			return
 		}
@@ -246,48 +499,72 @@ func (server *WsServer) listenPubSubChannel() {
 			server.handleUserJoined(message)
 		case UserLeftAction:
 			server.handleUserLeft(message)
-		case JoinRoomPrivateAction:
-			server.handleUserJoinPrivate(message)
+		case JoinRoomPrivateAction, MemberJoinedAction:
+			server.handleMemberJoined(message)
+		case MemberLeftAction:
+			server.handleMemberLeft(message)
+		case RoomInviteAction:
+			server.handleRoomInvite(message)
 		}
 	}
 }
 
-func (server *WsServer) handleUserJoinPrivate(message Message) {
+// Every connection of the user on this node enters the room
+func (server *WsServer) handleMemberJoined(message Message) {
 
-	// Find client for given user, if found add the user to the room.
-	targetClient := server.findClientByID(message.Message)
-	if targetClient != nil {
-		targetClient.joinRoom(message.Target.GetName(), message.Sender)
+	for _, client := range server.findClientsByID(message.Message) {
+		client.followRoom(message.Target.GetID(), message.Sender)
 	}
 }
 
-func (server *WsServer) findUserByID(ID string) models.User {
+func (server *WsServer) handleMemberLeft(message Message) {
 
-	var foundUser models.User
-	for _, user := range server.users {
-		if user.GetID() == ID {
-			foundUser = user
-			break
-		}
+	for _, client := range server.findClientsByID(message.Message) {
+		client.unfollowRoom(message.Target.GetID())
+	}
+}
+
+func (server *WsServer) publishMemberJoined(client *Client, room *Room, sender models.User) {
+
+	message := &Message{
+		Action:  MemberJoinedAction,
+		Message: client.GetID(),
+		Target:  room,
+		Sender:  sender,
+	}
+
+	if err := server.pubSub.Publish(ctx, PubSubGeneralChannel, message.encode()); err != nil {
+		log.Println(err)
 	}
-	return foundUser
+}
+
+func (server *WsServer) publishMemberLeft(client *Client, room *Room) {
+
+	message := &Message{
+		Action:  MemberLeftAction,
+		Message: client.GetID(),
+		Target:  room,
+	}
+
+	if err := server.pubSub.Publish(ctx, PubSubGeneralChannel, message.encode()); err != nil {
+		log.Println(err)
+	}
+}
+
+func (server *WsServer) findUserByID(ID string) models.User {
+
+	return server.registry.findUserByID(ID)
 }
 
 func (server *WsServer) handleUserJoined(message Message) {
-	// Add the user to the slice
-	server.users = append(server.users, message.Sender)
-	server.broadcastToClients(message.encode())
+	// The same user may connect more than once, the registry keeps one entry
+	server.registry.addUser(message.Sender)
+	server.broadcastToClients(message.Action, message.encode())
 }
 
 func (server *WsServer) handleUserLeft(message Message) {
 
-	// Remove the user from the slice
-	for i, user := range server.users {
-		if user.GetID() == message.Sender.GetID() {
-			server.users[i] = server.users[len(server.users)-1]
-			server.users = server.users[:len(server.users)-1]
-		}
-	}
+	server.registry.removeUser(message.Sender.GetID())
 
-	server.broadcastToClients(message.encode())
+	server.broadcastToClients(message.Action, message.encode())
 }
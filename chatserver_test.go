@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"chat/migrations"
+	"chat/presence"
+	"chat/pubsub"
+	"chat/session"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestServer runs a server on an in-memory database, rooms unload
+// right after their last client leaves
+func newTestServer(t *testing.T) (*WsServer, *presence.Memory) {
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection would open a database of its own
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrations.NewMigrator(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	options := ServerOptions{
+		RoomIdleTimeout:    time.Millisecond,
+		SlowConsumerPolicy: DropMessage,
+		PresenceTTL:        time.Minute,
+		HeartbeatInterval:  10 * time.Millisecond,
+	}
+	presenceStore := presence.NewMemory()
+	repositories := newRepositories("sqlite3", db)
+	server, err := NewWebsocketServer(
+		options,
+		pubsub.NewMemory(),
+		presenceStore,
+		session.NewMemory(),
+		repositories.rooms,
+		repositories.messages,
+		repositories.accounts,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Run()
+	t.Cleanup(func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return server, presenceStore
+}
+
+// waitForLoop returns once the server loop handled the requests sent before,
+// it takes one request at a time
+func waitForLoop(server *WsServer) {
+	server.broadcast <- &Message{}
+}
+
+func TestServerRegisterClients(t *testing.T) {
+
+	server, presenceStore := newTestServer(t)
+	userID := uuid.New()
+	first := newTestClient(server, userID)
+	second := newTestClient(server, userID)
+
+	server.register <- first
+	server.register <- second
+	waitForLoop(server)
+
+	if got := len(server.findClientsByID(userID.String())); got != 2 {
+		t.Fatalf("findClientsByID returned %d clients, want 2", got)
+	}
+
+	server.unregister <- first
+	server.unregister <- first
+	waitForLoop(server)
+
+	if clients := server.findClientsByID(userID.String()); len(clients) != 1 || clients[0] != second {
+		t.Fatalf("findClientsByID returned %v, want the second client only", clients)
+	}
+
+	online, err := presenceStore.Online(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(online) != 1 {
+		t.Fatalf("%d users online, want 1", len(online))
+	}
+
+	server.unregister <- second
+}
+
+// Run with -race, clients register and unregister through the server loop
+// while rooms are loaded by the clients and unloaded by the loop once idle
+func TestServerConcurrentClientsAndRooms(t *testing.T) {
+
+	server, presenceStore := newTestServer(t)
+	for i := 0; i < 5; i++ {
+		if _, err := server.createRoom(fmt.Sprintf("room-%d", i), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				client := newTestClient(server, uuid.New())
+				server.register <- client
+				server.findClientsByID(client.GetID())
+
+				room, err := server.findRoomByName(fmt.Sprintf("room-%d", (i+j)%5))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if room == nil {
+					t.Error("room not found")
+					return
+				}
+				if _, err := server.findRoomByID(room.GetID()); err != nil {
+					t.Error(err)
+					return
+				}
+
+				server.unregister <- client
+			}
+		}(i)
+	}
+	wg.Wait()
+	waitForLoop(server)
+
+	if got := len(server.registry.clientList()); got != 0 {
+		t.Fatalf("%d clients left, want 0", got)
+	}
+
+	online, err := presenceStore.Online(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(online) != 0 {
+		t.Fatalf("%d users online, want 0", len(online))
+	}
+}
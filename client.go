@@ -2,49 +2,54 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
-	"chat/config"
+	"chat/auth"
+	"chat/metrics"
 	"chat/models"
+	"chat/session"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
-const (
-	// Max wait time when writing message to peer
-	writeWait = 10 * time.Second
-
-	// Max time till next pong from peer
-	pongWait = 60 * time.Second
-
-	// Send ping interval, must be less then pong wait time
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer
-	maxMessageSize = 10000
-)
+// Number of last room messages sent to a client joining the room
+const roomHistoryLimit = 50
 
 var (
 	newLine = []byte{'\n'}
 	space   = []byte{' '}
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  4096,
-	WriteBufferSize: 4096,
-}
+var (
+	errRoomForbidden    = errors.New("room is private")
+	errRoomNameReserved = errors.New("room name is reserved")
+)
 
 // Client represents the websocket client at the server
 type Client struct {
-	ID       uuid.UUID `json:"id"`
-	conn     *websocket.Conn
-	wsServer *WsServer
-	send     chan []byte
-	rooms    map[*Room]bool
-	Name     string `json:"name"`
+	ID uuid.UUID `json:"id"`
+	// Tells apart connections of the same user in presence
+	connectionID string
+	// Resumes the rooms of this connection after it drops
+	sessionToken string
+	conn         *websocket.Conn
+	wsServer     *WsServer
+	send         chan []byte
+	done         chan struct{}
+	doneOnce     sync.Once
+	kickOnce     sync.Once
+	rooms        map[*Room]bool
+	// Guards rooms, private room joins arrive through the pub/sub listener
+	roomsLock sync.RWMutex
+	limiter   *tokenBucket
+	Name      string `json:"name"`
 }
 
 // GetName gets client name
@@ -57,16 +62,30 @@ func (client *Client) GetID() string {
 	return client.ID.String()
 }
 
-func newClient(conn *websocket.Conn, wsServer *WsServer, name string) *Client {
+func newClient(conn *websocket.Conn, wsServer *WsServer, user models.User) (*Client, error) {
 
-	return &Client{
-		ID:       uuid.New(),
-		Name:     name,
-		conn:     conn,
-		wsServer: wsServer,
-		send:     make(chan []byte),
-		rooms:    make(map[*Room]bool),
+	id, err := uuid.Parse(user.GetID())
+	if err != nil {
+		return nil, err
 	}
+
+	sessionToken, err := session.NewToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		ID:           id,
+		connectionID: uuid.New().String(),
+		sessionToken: sessionToken,
+		Name:         user.GetName(),
+		conn:         conn,
+		wsServer:     wsServer,
+		send:         make(chan []byte, wsServer.options.Websocket.SendQueueSize),
+		done:         make(chan struct{}),
+		rooms:        make(map[*Room]bool),
+		limiter:      newTokenBucket(wsServer.options.Websocket.MessageBurst, wsServer.options.Websocket.MessageRate),
+	}, nil
 }
 
 func (client *Client) readPump() {
@@ -75,11 +94,12 @@ func (client *Client) readPump() {
 		client.disconnect()
 	}()
 
-	client.conn.SetReadLimit(maxMessageSize)
-	client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	options := client.wsServer.options.Websocket
+	client.conn.SetReadLimit(options.MaxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(options.PongWait))
 	client.conn.SetPongHandler(
 		func(string) error {
-			client.conn.SetReadDeadline(time.Now().Add(pongWait))
+			client.conn.SetReadDeadline(time.Now().Add(options.PongWait))
 			return nil
 		},
 	)
@@ -88,7 +108,7 @@ func (client *Client) readPump() {
 	for {
 		_, jsonMessage, err := client.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseServiceRestart) {
 				log.Printf("unexpected close error %s", err)
 			}
 			break
@@ -100,7 +120,8 @@ func (client *Client) readPump() {
 
 func (client *Client) writePump() {
 
-	ticker := time.NewTicker(pingPeriod)
+	options := client.wsServer.options.Websocket
+	ticker := time.NewTicker(options.PingPeriod)
 	defer func() {
 		ticker.Stop()
 		client.conn.Close()
@@ -109,14 +130,13 @@ func (client *Client) writePump() {
 	for {
 		select {
 
-		case message, ok := <-client.send:
-			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		case <-client.done:
+			client.conn.SetWriteDeadline(time.Now().Add(options.WriteWait))
+			client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
 
-			if !ok {
-				// The WsServer closed the channel.
-				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+		case message := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(options.WriteWait))
 
 			w, err := client.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
@@ -125,11 +145,15 @@ func (client *Client) writePump() {
 			w.Write(message)
 
 			// Attach queued chat messages to the current websocket message.
+			// Dropping the oldest message may empty the queue meanwhile, so never block here.
 			n := len(client.send)
 			for i := 0; i < n; i++ {
-				w.Write(newLine)
-				w.Write(<-client.send)
-
+				select {
+				case queued := <-client.send:
+					w.Write(newLine)
+					w.Write(queued)
+				default:
+				}
 			}
 
 			if err := w.Close(); err != nil {
@@ -137,7 +161,7 @@ func (client *Client) writePump() {
 			}
 
 		case <-ticker.C:
-			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			client.conn.SetWriteDeadline(time.Now().Add(options.WriteWait))
 			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -148,11 +172,20 @@ func (client *Client) writePump() {
 
 func (client *Client) disconnect() {
 
-	client.wsServer.unregister <- client
-	for room := range client.rooms {
-		room.unregister <- client
+	// The server and rooms may already be stopped when shutting down
+	select {
+	case client.wsServer.unregister <- client:
+	case <-client.wsServer.done:
 	}
-	close(client.send)
+
+	for _, room := range client.roomList() {
+		select {
+		case room.unregister <- client:
+		case <-room.quit:
+		}
+	}
+	client.saveSession()
+	client.doneOnce.Do(func() { close(client.done) })
 	client.conn.Close()
 
 }
@@ -162,6 +195,19 @@ func (client *Client) handleNewMessage(jsonMessage []byte) {
 	var message Message
 	if err := json.Unmarshal(jsonMessage, &message); err != nil {
 		log.Printf("Error while unmarshaling json %s", err)
+		metrics.MessagesReceived.WithLabelValues("invalid").Inc()
+		client.sendError("", ErrorCodeInvalidMessage, "malformed message")
+		return
+	}
+
+	if clientActions[message.Action] {
+		metrics.MessagesReceived.WithLabelValues(message.Action).Inc()
+	} else {
+		metrics.MessagesReceived.WithLabelValues("unknown").Inc()
+	}
+
+	if !client.limiter.allow() {
+		client.sendError(message.RequestID, ErrorCodeRateLimited, "too many messages")
 		return
 	}
 
@@ -172,11 +218,7 @@ func (client *Client) handleNewMessage(jsonMessage []byte) {
 	// The send-message action, this will send messages to a specific room now.
 	// Which room wil depend on the message Target
 	case SendMessageAction:
-		roomID := message.Target.GetID()
-		// Use the ChatServer method to find the room, and if found, broadcast!
-		if room := client.wsServer.findRoomByID(roomID); room != nil {
-			room.broadcast <- &message
-		}
+		client.handleSendMessage(message)
 
 		// We delegate the join and leave actions
 	case JoinRoomAction:
@@ -188,10 +230,128 @@ func (client *Client) handleNewMessage(jsonMessage []byte) {
 	case JoinRoomPrivateAction:
 		client.handleJoinRoomPrivateMessage(message)
 
+	case CreateGroupAction:
+		client.handleCreateGroupMessage(message)
+
+	case InviteUserAction:
+		client.handleInviteUserMessage(message)
+
+	case AcceptInviteAction:
+		client.handleAcceptInviteMessage(message)
+
+	case DeclineInviteAction:
+		client.handleDeclineInviteMessage(message)
+
+	case TypingAction:
+		client.handleTypingMessage(message)
+
+	case MarkReadAction:
+		client.handleMarkReadMessage(message)
+
+	case EditMessageAction:
+		client.handleEditMessage(message)
+
+	case DeleteMessageAction:
+		client.handleDeleteMessage(message)
+
+	case PromoteMemberAction:
+		client.handlePromoteMemberMessage(message)
+
+	case DemoteMemberAction:
+		client.handleDemoteMemberMessage(message)
+
+	default:
+		client.sendError(message.RequestID, ErrorCodeUnknownAction, "unknown action "+message.Action)
 	}
 
 }
 
+func (client *Client) handleSendMessage(message Message) {
+
+	if message.Target == nil {
+		client.sendError(message.RequestID, ErrorCodeRoomNotFound, "room not found")
+		return
+	}
+
+	// Use the ChatServer method to find the room, and if found, broadcast!
+	room, err := client.wsServer.findRoomByID(message.Target.GetID())
+	if err != nil {
+		log.Printf("Error on finding room %s: %s", message.Target.GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not send message")
+		return
+	}
+
+	if room == nil {
+		client.sendError(message.RequestID, ErrorCodeRoomNotFound, "room not found")
+		return
+	}
+
+	member, err := client.isRoomMember(room)
+	if err != nil {
+		log.Printf("Error on checking membership of room %s: %s", room.GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not send message")
+		return
+	}
+
+	if !member {
+		client.sendError(message.RequestID, ErrorCodeNotAMember, "not a member of the room")
+		return
+	}
+
+	// Members get the room as stored, not as the sender described it
+	message.Target = room
+	message.stamp()
+	if err := client.wsServer.messageRepository.AddMessage(ctx, &message); err != nil {
+		log.Printf("Error on storing message %s", err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not send message")
+		return
+	}
+
+	// An idle room may stop right after being found, then it is loaded again
+	for {
+		select {
+		case room.broadcast <- &message:
+			client.sendAck(message.RequestID)
+			return
+		case <-room.quit:
+		}
+
+		if room, err = client.reloadRoom(room); err != nil {
+			log.Printf("Error on reloading room %s", err)
+			client.sendError(message.RequestID, ErrorCodeInternal, "could not send message")
+			return
+		}
+	}
+}
+
+// Tells the client its request failed
+func (client *Client) sendError(requestID string, code string, text string) {
+
+	message := &Message{
+		Action:    ErrorAction,
+		RequestID: requestID,
+		Code:      code,
+		Message:   text,
+	}
+
+	client.sendMessage(message)
+}
+
+// Tells the client its request succeeded, if the client asked for it with a request id
+func (client *Client) sendAck(requestID string) {
+
+	if requestID == "" {
+		return
+	}
+
+	message := &Message{
+		Action:    AckAction,
+		RequestID: requestID,
+	}
+
+	client.sendMessage(message)
+}
+
 func (client *Client) notifyRoomJoined(room *Room, sender models.User) {
 
 	message := &Message{
@@ -200,62 +360,451 @@ func (client *Client) notifyRoomJoined(room *Room, sender models.User) {
 		Sender: sender,
 	}
 
-	client.send <- message.encode()
+	client.sendMessage(message)
 }
 
 // Joining a room both for public and private roooms
 // When joining a private room a sender is passed as the opposing party
-func (client *Client) joinRoom(roomName string, sender models.User) *Room {
+// Missing rooms are created as public, private rooms are created upfront with their members
+func (client *Client) joinRoom(roomName string, sender models.User) (*Room, error) {
+
+	room, err := client.wsServer.findRoomByName(roomName)
+	if err != nil {
+		return nil, err
+	}
+
+	created := false
+	if room == nil {
+		if isDirectRoomName(roomName) {
+			return nil, errRoomNameReserved
+		}
+		room, err = client.wsServer.createRoom(roomName, false)
+		if err != nil {
+			return nil, err
+		}
+		created = true
+	}
+
+	if client.IsInRoom(room) {
+		return room, nil
+	}
+
+	// Only members are allowed into private rooms
+	member, err := client.wsServer.roomRepository.IsRoomMember(ctx, room.GetID(), client.GetID())
+	if err != nil {
+		return nil, err
+	}
+	if room.Private && !member {
+		return nil, errRoomForbidden
+	}
+
+	// Rooms are announced once per user, not for each of its connections
+	if !member {
+		// Whoever creates a public room owns it and may appoint moderators
+		role := models.RoleMember
+		if created {
+			role = models.RoleOwner
+		}
+		if err := client.wsServer.roomRepository.AddRoomMember(ctx, room.GetID(), client.GetID(), role); err != nil {
+			return nil, err
+		}
+		room.notifyClientJoined(client)
+	}
+
+	entered, err := client.enterRoom(room, sender, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	// Another request of the connection entered the room meanwhile and announced it
+	if entered == nil {
+		return room, nil
+	}
+	room = entered
+	client.sendUnreadCounts([]*Room{room})
+
+	// Other connections of the user follow into the room
+	client.wsServer.publishMemberJoined(client, room, sender)
+
+	return room, nil
+}
+
+// Enters the room with ID on behalf of another connection of the user, or when
+// the user was added to the room. The user has to be a member already.
+func (client *Client) followRoom(roomID string, sender models.User) {
+
+	room, err := client.wsServer.findRoomByID(roomID)
+	if err != nil {
+		log.Printf("Error on finding room %s: %s", roomID, err)
+		return
+	}
+
+	if room == nil || !client.tryAddRoom(room) {
+		return
+	}
+
+	if err := client.announceRoom(room, sender); err != nil {
+		client.removeRoom(room)
+		log.Printf("Error on entering room %s: %s", roomID, err)
+		client.sendError("", ErrorCodeInternal, "could not join room")
+		return
+	}
+
+	if room, err = client.settleInRoom(room); err != nil {
+		log.Printf("Error on entering room %s: %s", roomID, err)
+		client.sendError("", ErrorCodeInternal, "could not join room")
+		return
+	}
+	if room == nil {
+		return
+	}
 
-	room := client.wsServer.findRoomByName(roomName)
+	// The pub/sub listener must not wait for the client to take the history,
+	// so it follows in the background and may interleave with live room traffic
+	go func() {
+		client.sendRoomBacklog(room, time.Time{})
+		client.sendUnreadCounts([]*Room{room})
+	}()
+}
+
+// Leaves the room with ID after another connection of the user left it
+func (client *Client) unfollowRoom(roomID string) {
+
+	room := client.findRoom(roomID)
 	if room == nil {
-		room = client.wsServer.createRoom(roomName, sender != nil)
+		return
+	}
+
+	client.removeRoom(room)
+	select {
+	case room.unregister <- client:
+	case <-room.quit:
+	}
+	client.sendMessage(&Message{Action: RoomLeftAction, Target: room})
+}
+
+// Enters every room the user is a member of, a non zero since
+// replays the messages stored after it instead of the history
+func (client *Client) enterMemberRooms(since time.Time) {
+
+	rooms, err := client.wsServer.roomRepository.GetUserRooms(ctx, client.GetID())
+	if err != nil {
+		log.Printf("Error on loading rooms of user %s: %s", client.GetID(), err)
+		client.sendError("", ErrorCodeInternal, "could not load rooms")
+		return
+	}
+
+	for _, dbRoom := range rooms {
+		room, err := client.wsServer.findRoomByID(dbRoom.GetID())
+		if err != nil {
+			log.Printf("Error on finding room %s: %s", dbRoom.GetID(), err)
+			client.sendError("", ErrorCodeInternal, "could not join room")
+			continue
+		}
+		if room == nil {
+			continue
+		}
+
+		if _, err := client.enterRoom(room, nil, since); err != nil {
+			log.Printf("Error on entering room %s: %s", room.GetID(), err)
+			client.sendError("", ErrorCodeInternal, "could not join room")
+		}
+	}
+}
+
+// Sends the room along with its history to the client and registers the client in it.
+// History goes out before registering, so it precedes live room traffic.
+// A zero since sends the last messages, otherwise the messages stored after since.
+// Returns nil without an error when the client entered or left the room meanwhile.
+func (client *Client) enterRoom(room *Room, sender models.User, since time.Time) (*Room, error) {
+
+	// Connect, join and follow may race for the same room, only the first enters it
+	if !client.tryAddRoom(room) {
+		return nil, nil
+	}
+
+	if err := client.announceRoom(room, sender); err != nil {
+		client.removeRoom(room)
+		return nil, err
 	}
+	client.sendRoomBacklog(room, since)
+
+	return client.settleInRoom(room)
+}
+
+// Tells the client it is in the room, direct rooms are shown as the other party
+func (client *Client) announceRoom(room *Room, sender models.User) error {
 
-	// Don't allow to join private rooms through public room message
 	if sender == nil && room.Private {
-		return nil
+		peer, err := client.directRoomPeer(room)
+		if err != nil {
+			return err
+		}
+		sender = peer
+	}
+
+	client.notifyRoomJoined(room, sender)
+
+	return nil
+}
+
+// A zero since sends the last messages of the room, otherwise the messages stored after since
+func (client *Client) sendRoomBacklog(room *Room, since time.Time) {
+
+	if since.IsZero() {
+		client.sendRoomHistory(room)
+	} else {
+		client.sendMissedMessages(room, since)
 	}
+}
 
-	if !client.IsInRoom(room) {
-		client.rooms[room] = true
-		room.register <- client
-		client.notifyRoomJoined(room, sender)
+// Registers the client in the room it was added to for live traffic,
+// returns nil when the client left the room meanwhile
+func (client *Client) settleInRoom(room *Room) (*Room, error) {
+
+	registered, err := client.registerInRoom(room)
+	if err != nil {
+		client.removeRoom(room)
+		return nil, err
 	}
 
-	return room
+	// The room may have been reloaded while registering
+	if !client.replaceRoom(room, registered) {
+		select {
+		case registered.unregister <- client:
+		case <-registered.quit:
+		}
+		return nil, nil
+	}
+
+	return registered, nil
+}
+
+// Returns the other member of a direct room, nil for any other room
+func (client *Client) directRoomPeer(room *Room) (models.User, error) {
+
+	members, err := client.wsServer.roomRepository.GetRoomMembers(ctx, room.GetID())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, member := range members {
+		if member.GetID() != client.GetID() && directRoomName(client.GetID(), member.GetID()) == room.GetName() {
+			return member, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Registers the client in the room, an idle room may stop right after
+// being found, then it is loaded again
+func (client *Client) registerInRoom(room *Room) (*Room, error) {
+
+	for {
+		select {
+		case room.register <- client:
+			return room, nil
+		case <-room.quit:
+		}
+
+		var err error
+		if room, err = client.reloadRoom(room); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (client *Client) reloadRoom(room *Room) (*Room, error) {
+
+	reloaded, err := client.wsServer.findRoomByID(room.GetID())
+	if err != nil {
+		return nil, err
+	}
+
+	if reloaded == nil {
+		return nil, fmt.Errorf("room %s no longer exists", room.GetID())
+	}
+
+	return reloaded, nil
+}
+
+// Sends last persisted messages of the room to the client
+func (client *Client) sendRoomHistory(room *Room) {
+
+	messages, err := client.wsServer.messageRepository.GetRoomMessages(ctx, room.GetID(), "", roomHistoryLimit)
+	if err != nil {
+		log.Printf("Error on loading history of room %s: %s", room.GetID(), err)
+		client.sendError("", ErrorCodeInternal, "could not load room history")
+		return
+	}
+
+	client.sendStoredMessages(room, messages)
+}
+
+// Sends messages of the room stored, edited or deleted at or after since, e.g. while the client was reconnecting
+func (client *Client) sendMissedMessages(room *Room, since time.Time) {
+
+	// One more than sent tells whether older missed messages were left out
+	messages, err := client.wsServer.messageRepository.GetRoomMessagesSince(ctx, room.GetID(), since, roomHistoryLimit+1)
+	if err != nil {
+		log.Printf("Error on loading missed messages of room %s: %s", room.GetID(), err)
+		client.sendError("", ErrorCodeInternal, "could not load missed messages")
+		return
+	}
+
+	// The client pages back from the oldest sent message over the api to fill the gap
+	if len(messages) > roomHistoryLimit {
+		messages = messages[1:]
+		truncated := &Message{
+			ID:     messages[0].GetID(),
+			Action: HistoryTruncatedAction,
+			Target: room,
+		}
+		if !client.sendWaiting(truncated) {
+			return
+		}
+	}
+
+	client.sendStoredMessages(room, messages)
+}
+
+// Sends stored messages without dropping any, so it must not run on a room or the server loop
+func (client *Client) sendStoredMessages(room *Room, messages []models.Message) {
+
+	for _, dbMessage := range messages {
+		message := &Message{
+			ID:        dbMessage.GetID(),
+			CreatedAt: dbMessage.GetCreatedAt(),
+			Action:    SendMessageAction,
+			Message:   dbMessage.GetMessage(),
+			Target:    room,
+			Sender:    dbMessage.GetSender(),
+			EditedAt:  dbMessage.GetEditedAt(),
+			DeletedAt: dbMessage.GetDeletedAt(),
+		}
+		if !client.sendWaiting(message) {
+			return
+		}
+	}
+}
+
+// Membership is persisted, so a client may be a member of a room
+// it has not joined on this connection or node
+func (client *Client) isRoomMember(room *Room) (bool, error) {
+
+	if client.IsInRoom(room) {
+		return true, nil
+	}
+
+	return client.wsServer.roomRepository.IsRoomMember(ctx, room.GetID(), client.GetID())
 }
 
 // IsInRoom returns true if client is already in room
 // Otherwise returns false
 func (client *Client) IsInRoom(room *Room) bool {
 
-	if _, ok := room.clients[client]; ok {
-		return true
+	client.roomsLock.RLock()
+	defer client.roomsLock.RUnlock()
+
+	_, ok := client.rooms[room]
+	return ok
+}
+
+// tryAddRoom adds the room unless the client is in it already, also
+// as a reloaded room with the same ID, returns true if it was added
+func (client *Client) tryAddRoom(room *Room) bool {
+	client.roomsLock.Lock()
+	defer client.roomsLock.Unlock()
+
+	for entered := range client.rooms {
+		if entered.GetID() == room.GetID() {
+			return false
+		}
+	}
+	client.rooms[room] = true
+
+	return true
+}
+
+// replaceRoom swaps the room for the one it was reloaded as,
+// returns false if the client is no longer in the room
+func (client *Client) replaceRoom(room *Room, reloaded *Room) bool {
+	client.roomsLock.Lock()
+	defer client.roomsLock.Unlock()
+
+	if _, ok := client.rooms[room]; !ok {
+		return false
 	}
+	delete(client.rooms, room)
+	client.rooms[reloaded] = true
+
+	return true
+}
+
+func (client *Client) removeRoom(room *Room) {
+	client.roomsLock.Lock()
+	defer client.roomsLock.Unlock()
 
-	return false
+	delete(client.rooms, room)
 }
 
-// When joining a private room we will combine the IDs of the users
+// findRoom returns the room with ID if the client entered it
+func (client *Client) findRoom(roomID string) *Room {
+	client.roomsLock.RLock()
+	defer client.roomsLock.RUnlock()
+
+	for room := range client.rooms {
+		if room.GetID() == roomID {
+			return room
+		}
+	}
+
+	return nil
+}
+
+func (client *Client) roomList() []*Room {
+	client.roomsLock.RLock()
+	defer client.roomsLock.RUnlock()
+
+	rooms := make([]*Room, 0, len(client.rooms))
+	for room := range client.rooms {
+		rooms = append(rooms, room)
+	}
+
+	return rooms
+}
+
+// When joining a private room we resolve the direct room of both users
 // Then we will bothe join the client and the target.
 func (client *Client) handleJoinRoomPrivateMessage(message Message) {
 
 	target := client.wsServer.findUserByID(message.Message)
 	if target == nil {
+		client.sendError(message.RequestID, ErrorCodeUserNotFound, "user not found")
+		return
+	}
+
+	if target.GetID() == client.GetID() {
+		client.sendError(message.RequestID, ErrorCodeInvalidMessage, "can't start a private chat with yourself")
 		return
 	}
 
-	// create unique room name combined to the two IDs
-	roomName := message.Message + client.ID.String()
+	room, err := client.wsServer.findOrCreateDirectRoom(client, target)
+	if err != nil {
+		client.sendJoinError(message.RequestID, directRoomName(client.GetID(), target.GetID()), err)
+		return
+	}
 
-	joinedRoom := client.joinRoom(roomName, target)
+	joinedRoom, err := client.joinRoom(room.GetName(), target)
+	if err != nil {
+		client.sendJoinError(message.RequestID, room.GetName(), err)
+		return
+	}
 
 	// Instead of instantaneously joining the target client.
 	// Let the target client join with a invite request over pub/sub
-	if joinedRoom != nil {
-		client.inviteTargetUser(target, joinedRoom)
-	}
+	client.inviteTargetUser(target, joinedRoom)
+	client.sendAck(message.RequestID)
 }
 
 func (client *Client) inviteTargetUser(target models.User, room *Room) {
@@ -267,7 +816,7 @@ func (client *Client) inviteTargetUser(target models.User, room *Room) {
 		Sender:  client,
 	}
 
-	if err := config.Redis.Publish(ctx, PubSubGeneralChannel, inviteMessage.encode()).Err(); err != nil {
+	if err := client.wsServer.pubSub.Publish(ctx, PubSubGeneralChannel, inviteMessage.encode()); err != nil {
 		log.Println(err)
 	}
 }
@@ -276,43 +825,172 @@ func (client *Client) handleJoinRoomMessage(message Message) {
 
 	roomName := message.Message
 
-	client.joinRoom(roomName, nil)
+	if _, err := client.joinRoom(roomName, nil); err != nil {
+		client.sendJoinError(message.RequestID, roomName, err)
+		return
+	}
+
+	client.sendAck(message.RequestID)
+}
+
+func (client *Client) sendJoinError(requestID string, roomName string, err error) {
+
+	if err == errRoomForbidden {
+		client.sendError(requestID, ErrorCodeForbidden, "room is private")
+		return
+	}
+
+	if err == errRoomNameReserved {
+		client.sendError(requestID, ErrorCodeForbidden, "room name is reserved")
+		return
+	}
 
+	log.Printf("Error on joining room %s: %s", roomName, err)
+	client.sendError(requestID, ErrorCodeInternal, "could not join room")
 }
 
 func (client *Client) handleLeaveRoomMessage(message Message) {
 
-	room := client.wsServer.findRoomByID(message.Message)
+	room, err := client.wsServer.findRoomByID(message.Message)
+	if err != nil {
+		log.Printf("Error on finding room %s: %s", message.Message, err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not leave room")
+		return
+	}
+
 	if room == nil {
+		client.sendError(message.RequestID, ErrorCodeRoomNotFound, "room not found")
+		return
+	}
+
+	member, err := client.isRoomMember(room)
+	if err != nil {
+		log.Printf("Error on checking membership of room %s: %s", room.GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not leave room")
+		return
+	}
+
+	if !member {
+		client.sendError(message.RequestID, ErrorCodeNotAMember, "not a member of the room")
 		return
 	}
 
-	if _, ok := client.rooms[room]; ok {
-		delete(client.rooms, room)
+	// Only the owner brings in members and moderators, so it stays until it is the last member
+	ownsMembers, err := client.isOwnerWithMembers(room)
+	if err != nil {
+		log.Printf("Error on checking owner of room %s: %s", room.GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not leave room")
+		return
+	}
+
+	if ownsMembers {
+		client.sendError(message.RequestID, ErrorCodeForbidden, "the owner can't leave while the room has other members")
+		return
+	}
+
+	if err := client.wsServer.roomRepository.RemoveRoomMember(ctx, room.GetID(), client.GetID()); err != nil {
+		log.Printf("Error on removing member of room %s: %s", room.GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not leave room")
+		return
+	}
+
+	client.removeRoom(room)
+	select {
+	case room.unregister <- client:
+	case <-room.quit:
+	}
+	client.wsServer.publishMemberLeft(client, room)
+	client.sendAck(message.RequestID)
+}
+
+// Returns true if the client owns the room and other members remain
+func (client *Client) isOwnerWithMembers(room *Room) (bool, error) {
+
+	role, err := client.wsServer.roomRepository.GetRoomMemberRole(ctx, room.GetID(), client.GetID())
+	if err != nil || role != models.RoleOwner {
+		return false, err
+	}
+
+	members, err := client.wsServer.roomRepository.GetRoomMembers(ctx, room.GetID())
+	if err != nil {
+		return false, err
 	}
 
-	room.unregister <- client
+	return len(members) > 1, nil
 }
 
 // ServeWs ...
 func ServeWs(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
 
-	name, ok := r.URL.Query()["name"]
+	if wsServer.Draining() {
+		metrics.UpgradeFailures.WithLabelValues("draining").Inc()
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 
-	if !ok || len(name[0]) < 1 {
-		log.Println("Url param 'name' is missing")
+	user, err := auth.ValidateToken(tokenFromRequest(r))
+	if err != nil {
+		metrics.UpgradeFailures.WithLabelValues("unauthorized").Inc()
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := wsServer.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		metrics.UpgradeFailures.WithLabelValues("upgrade").Inc()
 		log.Println(err)
 		return
 	}
 
-	client := newClient(conn, wsServer, name[0])
+	client, err := newClient(conn, wsServer, user)
+	if err != nil {
+		metrics.UpgradeFailures.WithLabelValues("invalid-user").Inc()
+		log.Println(err)
+		conn.Close()
+		return
+	}
 	go client.writePump()
+	client.sendSession()
+
+	resumed := client.takeSession(r.URL.Query().Get("session"))
+
+	select {
+	case wsServer.register <- client:
+	case <-wsServer.done:
+		client.close(websocket.CloseServiceRestart, "server restarting")
+		client.doneOnce.Do(func() { close(client.done) })
+		return
+	}
+
+	// Rooms are entered before reading, so the client's own messages
+	// can't overtake the history
+	var since time.Time
+	if resumed != nil {
+		since = client.missedSince(resumed, r.URL.Query().Get("lastMessageId"))
+	}
+	client.enterMemberRooms(since)
+	client.sendUnreadCounts(client.roomList())
 	go client.readPump()
+}
+
+// Sends a close frame with the reason and closes the connection
+func (client *Client) close(code int, reason string) {
+
+	message := websocket.FormatCloseMessage(code, reason)
+	deadline := time.Now().Add(client.wsServer.options.Websocket.WriteWait)
+	if err := client.conn.WriteControl(websocket.CloseMessage, message, deadline); err != nil {
+		log.Println(err)
+	}
+	client.conn.Close()
+}
+
+// Browsers can't set headers on websocket requests, so the token
+// may also be passed in the 'bearer' url param.
+func tokenFromRequest(r *http.Request) string {
+
+	if token := r.URL.Query().Get("bearer"); token != "" {
+		return token
+	}
 
-	wsServer.register <- client
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 }
@@ -0,0 +1,303 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds all settings of the chat server
+type Config struct {
+	Addr            string        `yaml:"addr"`
+	StaticDir       string        `yaml:"static_dir"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// Time between turning unready and closing connections on shutdown
+	DrainDelay time.Duration   `yaml:"drain_delay"`
+	PubSub     string          `yaml:"pubsub"`
+	TLS        TLSConfig       `yaml:"tls"`
+	Auth       AuthConfig      `yaml:"auth"`
+	Database   DatabaseConfig  `yaml:"database"`
+	Redis      RedisConfig     `yaml:"redis"`
+	Websocket  WebsocketConfig `yaml:"websocket"`
+	Rooms      RoomsConfig     `yaml:"rooms"`
+	Presence   PresenceConfig  `yaml:"presence"`
+	Session    SessionConfig   `yaml:"session"`
+}
+
+// TLSConfig enables https when both files are set
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// Enabled returns true if the server should listen with TLS
+func (tls TLSConfig) Enabled() bool {
+	return tls.CertFile != "" && tls.KeyFile != ""
+}
+
+// AuthConfig ...
+type AuthConfig struct {
+	// Key used to sign auth tokens, a random one is generated when empty
+	Secret string `yaml:"secret"`
+}
+
+// DatabaseConfig ...
+type DatabaseConfig struct {
+	// sqlite3 for a single node, postgres to share the database between nodes
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+	// Apply pending migrations at startup, otherwise run the migrate subcommand
+	AutoMigrate bool `yaml:"auto_migrate"`
+}
+
+// RedisConfig ...
+type RedisConfig struct {
+	URL string `yaml:"url"`
+}
+
+// WebsocketConfig holds the limits of websocket connections
+type WebsocketConfig struct {
+	// Max wait time when writing message to peer
+	WriteWait time.Duration `yaml:"write_wait"`
+	// Max time till next pong from peer
+	PongWait time.Duration `yaml:"pong_wait"`
+	// Send ping interval, must be less then pong wait time
+	PingPeriod time.Duration `yaml:"ping_period"`
+	// Maximum message size allowed from peer
+	MaxMessageSize  int64 `yaml:"max_message_size"`
+	ReadBufferSize  int   `yaml:"read_buffer_size"`
+	WriteBufferSize int   `yaml:"write_buffer_size"`
+	// Number of outbound messages queued per client
+	SendQueueSize int `yaml:"send_queue_size"`
+	// drop-oldest, drop-message or disconnect
+	SlowConsumerPolicy string `yaml:"slow_consumer_policy"`
+	// Messages a client may send in a burst, refilled at MessageRate per second
+	MessageBurst int     `yaml:"message_burst"`
+	MessageRate  float64 `yaml:"message_rate"`
+}
+
+// RoomsConfig ...
+type RoomsConfig struct {
+	// Rooms without clients are unloaded after this period, zero keeps them loaded
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+// PresenceConfig ...
+type PresenceConfig struct {
+	// Connections not refreshed for this long are offline, e.g. after a node crashed
+	TTL time.Duration `yaml:"ttl"`
+	// Interval of refreshing the connections of a node, must be less than the ttl
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+}
+
+// SessionConfig ...
+type SessionConfig struct {
+	// How long a dropped connection may be resumed with its session token
+	GracePeriod time.Duration `yaml:"grace_period"`
+}
+
+// Default returns the settings used for anything not configured
+func Default() *Config {
+	return &Config{
+		Addr:            ":8080",
+		StaticDir:       "./public",
+		ShutdownTimeout: 10 * time.Second,
+		DrainDelay:      5 * time.Second,
+		PubSub:          "redis",
+		Database: DatabaseConfig{
+			Driver:      "sqlite3",
+			DSN:         "./chatdb.db",
+			AutoMigrate: true,
+		},
+		Redis: RedisConfig{
+			URL: "redis://localhost:6364/0",
+		},
+		Websocket: WebsocketConfig{
+			WriteWait:          10 * time.Second,
+			PongWait:           60 * time.Second,
+			PingPeriod:         54 * time.Second,
+			MaxMessageSize:     10000,
+			ReadBufferSize:     4096,
+			WriteBufferSize:    4096,
+			SendQueueSize:      256,
+			SlowConsumerPolicy: "drop-oldest",
+			MessageBurst:       10,
+			MessageRate:        5,
+		},
+		Rooms: RoomsConfig{
+			IdleTimeout: 5 * time.Minute,
+		},
+		Presence: PresenceConfig{
+			TTL:               30 * time.Second,
+			HeartbeatInterval: 10 * time.Second,
+		},
+		Session: SessionConfig{
+			GracePeriod: 2 * time.Minute,
+		},
+	}
+}
+
+// Load reads the yaml file at path on top of the defaults, an empty path
+// skips the file. Environment variables override both.
+func Load(path string) (*Config, error) {
+
+	config := Default()
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	return config, config.Validate()
+}
+
+// Environment variables have the CHAT_ prefix and follow the yaml keys,
+// e.g. CHAT_WEBSOCKET_PONG_WAIT for websocket.pong_wait
+func (config *Config) applyEnv() error {
+
+	texts := map[string]*string{
+		"CHAT_ADDR":                           &config.Addr,
+		"CHAT_STATIC_DIR":                     &config.StaticDir,
+		"CHAT_PUBSUB":                         &config.PubSub,
+		"CHAT_TLS_CERT_FILE":                  &config.TLS.CertFile,
+		"CHAT_TLS_KEY_FILE":                   &config.TLS.KeyFile,
+		"CHAT_AUTH_SECRET":                    &config.Auth.Secret,
+		"CHAT_DATABASE_DRIVER":                &config.Database.Driver,
+		"CHAT_DATABASE_DSN":                   &config.Database.DSN,
+		"CHAT_REDIS_URL":                      &config.Redis.URL,
+		"CHAT_WEBSOCKET_SLOW_CONSUMER_POLICY": &config.Websocket.SlowConsumerPolicy,
+	}
+	for name, value := range texts {
+		if env, ok := os.LookupEnv(name); ok {
+			*value = env
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"CHAT_SHUTDOWN_TIMEOUT":            &config.ShutdownTimeout,
+		"CHAT_DRAIN_DELAY":                 &config.DrainDelay,
+		"CHAT_WEBSOCKET_WRITE_WAIT":        &config.Websocket.WriteWait,
+		"CHAT_WEBSOCKET_PONG_WAIT":         &config.Websocket.PongWait,
+		"CHAT_WEBSOCKET_PING_PERIOD":       &config.Websocket.PingPeriod,
+		"CHAT_ROOMS_IDLE_TIMEOUT":          &config.Rooms.IdleTimeout,
+		"CHAT_PRESENCE_TTL":                &config.Presence.TTL,
+		"CHAT_PRESENCE_HEARTBEAT_INTERVAL": &config.Presence.HeartbeatInterval,
+		"CHAT_SESSION_GRACE_PERIOD":        &config.Session.GracePeriod,
+	}
+	for name, value := range durations {
+		if env, ok := os.LookupEnv(name); ok {
+			parsed, err := time.ParseDuration(env)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			*value = parsed
+		}
+	}
+
+	ints := map[string]*int{
+		"CHAT_WEBSOCKET_READ_BUFFER_SIZE":  &config.Websocket.ReadBufferSize,
+		"CHAT_WEBSOCKET_WRITE_BUFFER_SIZE": &config.Websocket.WriteBufferSize,
+		"CHAT_WEBSOCKET_SEND_QUEUE_SIZE":   &config.Websocket.SendQueueSize,
+		"CHAT_WEBSOCKET_MESSAGE_BURST":     &config.Websocket.MessageBurst,
+	}
+	for name, value := range ints {
+		if env, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.Atoi(env)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			*value = parsed
+		}
+	}
+
+	if env, ok := os.LookupEnv("CHAT_DATABASE_AUTO_MIGRATE"); ok {
+		parsed, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("CHAT_DATABASE_AUTO_MIGRATE: %s", err)
+		}
+		config.Database.AutoMigrate = parsed
+	}
+
+	if env, ok := os.LookupEnv("CHAT_WEBSOCKET_MAX_MESSAGE_SIZE"); ok {
+		parsed, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return fmt.Errorf("CHAT_WEBSOCKET_MAX_MESSAGE_SIZE: %s", err)
+		}
+		config.Websocket.MaxMessageSize = parsed
+	}
+
+	if env, ok := os.LookupEnv("CHAT_WEBSOCKET_MESSAGE_RATE"); ok {
+		parsed, err := strconv.ParseFloat(env, 64)
+		if err != nil {
+			return fmt.Errorf("CHAT_WEBSOCKET_MESSAGE_RATE: %s", err)
+		}
+		config.Websocket.MessageRate = parsed
+	}
+
+	return nil
+}
+
+// Validate reports every invalid setting at once
+func (config *Config) Validate() error {
+
+	var problems []string
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	check(config.Addr != "", "addr is required")
+	check(config.StaticDir != "", "static_dir is required")
+	check(config.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+	check(config.DrainDelay >= 0, "drain_delay can't be negative")
+	check(config.PubSub == "redis" || config.PubSub == "memory", "pubsub must be redis or memory")
+	check((config.TLS.CertFile == "") == (config.TLS.KeyFile == ""), "tls needs both cert_file and key_file")
+	check(config.Database.Driver == "sqlite3" || config.Database.Driver == "postgres", "database.driver must be sqlite3 or postgres")
+	check(config.Database.DSN != "", "database.dsn is required")
+
+	if config.PubSub == "redis" {
+		_, err := redis.ParseURL(config.Redis.URL)
+		check(err == nil, "redis.url is invalid")
+	}
+
+	websocket := config.Websocket
+	check(websocket.WriteWait > 0, "websocket.write_wait must be positive")
+	check(websocket.PongWait > 0, "websocket.pong_wait must be positive")
+	check(websocket.PingPeriod > 0 && websocket.PingPeriod < websocket.PongWait, "websocket.ping_period must be positive and less than pong_wait")
+	check(websocket.MaxMessageSize > 0, "websocket.max_message_size must be positive")
+	check(websocket.ReadBufferSize > 0, "websocket.read_buffer_size must be positive")
+	check(websocket.WriteBufferSize > 0, "websocket.write_buffer_size must be positive")
+	check(websocket.SendQueueSize > 0, "websocket.send_queue_size must be positive")
+	check(websocket.MessageBurst > 0, "websocket.message_burst must be positive")
+	check(websocket.MessageRate > 0, "websocket.message_rate must be positive")
+
+	check(config.Rooms.IdleTimeout >= 0, "rooms.idle_timeout can't be negative")
+
+	presence := config.Presence
+	check(presence.HeartbeatInterval > 0 && presence.HeartbeatInterval < presence.TTL, "presence.heartbeat_interval must be positive and less than presence.ttl")
+
+	check(config.Session.GracePeriod >= 0, "session.grace_period can't be negative")
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
@@ -4,42 +4,18 @@ import (
 	"database/sql"
 	"log"
 
-	// database engine
+	// database engines
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// InitDB initializes database connection
-func InitDB() *sql.DB {
+// InitDB initializes database connection, the schema is managed by the migrations package
+func InitDB(driver string, dsn string) *sql.DB {
 
-	db, err := sql.Open("sqlite3", "./chatdb.db")
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	sqlStmt := `
-	CREATE TABLE IF NOT EXISTS room (
-		id VARCHAR(255) NOT NULL PRIMARY KEY,
-		name VARCHAR(255) NOT NULL,
-		private TINYINT NULL
-	);
-	`
-
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		log.Fatalf("%s: %s\n", err, sqlStmt)
-	}
-
-	sqlStmt = `
-	CREATE TABLE IF NOT EXISTS user (
-		id VARCHAR(255) NOT NULL PRIMARY KEY,
-		name VARCHAR(255) NOT NULL
-	);
-	`
-
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		log.Fatalf("%s: %s\n", err, sqlStmt)
-	}
-
 	return db
 }
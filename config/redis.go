@@ -10,8 +10,8 @@ import (
 var Redis *redis.Client
 
 // CreateRedisClient creates redis client
-func CreateRedisClient() {
-	opt, err := redis.ParseURL("redis://localhost:6364/0")
+func CreateRedisClient(url string) {
+	opt, err := redis.ParseURL(url)
 	if err != nil {
 		log.Fatal(err)
 	}
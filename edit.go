@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"chat/models"
+)
+
+// Replaces the text of the message with the ID of the message by its text
+func (client *Client) handleEditMessage(message Message) {
+
+	if message.Message == "" {
+		client.sendError(message.RequestID, ErrorCodeInvalidMessage, "message can't be empty")
+		return
+	}
+
+	stored, room, ok := client.findChangeableMessage(message)
+	if !ok {
+		return
+	}
+
+	editedAt := time.Now().UTC()
+	edited, err := client.wsServer.messageRepository.EditMessage(ctx, stored.GetID(), message.Message, editedAt)
+	if err != nil {
+		log.Printf("Error on editing message %s: %s", stored.GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not edit message")
+		return
+	}
+
+	// Deleted in the meantime
+	if !edited {
+		client.sendError(message.RequestID, ErrorCodeNoMessage, "message not found")
+		return
+	}
+
+	client.publishMessageUpdate(room, stored, message.Message, &editedAt, nil)
+	client.sendAck(message.RequestID)
+}
+
+// Deletes the message with the ID of the message
+func (client *Client) handleDeleteMessage(message Message) {
+
+	stored, room, ok := client.findChangeableMessage(message)
+	if !ok {
+		return
+	}
+
+	deletedAt := time.Now().UTC()
+	deleted, err := client.wsServer.messageRepository.DeleteMessage(ctx, stored.GetID(), deletedAt)
+	if err != nil {
+		log.Printf("Error on deleting message %s: %s", stored.GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not delete message")
+		return
+	}
+
+	if !deleted {
+		client.sendError(message.RequestID, ErrorCodeNoMessage, "message not found")
+		return
+	}
+
+	client.publishMessageUpdate(room, stored, "", stored.GetEditedAt(), &deletedAt)
+	client.sendAck(message.RequestID)
+}
+
+// Finds the message to edit or delete, only its sender and moderators of
+// the room may change it. Returns false after telling the client what went wrong.
+func (client *Client) findChangeableMessage(message Message) (models.Message, *Room, bool) {
+
+	stored, err := client.wsServer.messageRepository.FindMessageByID(ctx, message.ID)
+	if err != nil {
+		log.Printf("Error on finding message %s: %s", message.ID, err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not change message")
+		return nil, nil, false
+	}
+
+	if stored == nil || stored.GetDeletedAt() != nil {
+		client.sendError(message.RequestID, ErrorCodeNoMessage, "message not found")
+		return nil, nil, false
+	}
+
+	room, err := client.wsServer.findRoomByID(stored.GetTarget().GetID())
+	if err != nil {
+		log.Printf("Error on finding room %s: %s", stored.GetTarget().GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not change message")
+		return nil, nil, false
+	}
+
+	if room == nil {
+		client.sendError(message.RequestID, ErrorCodeRoomNotFound, "room not found")
+		return nil, nil, false
+	}
+
+	role, err := client.wsServer.roomRepository.GetRoomMemberRole(ctx, room.GetID(), client.GetID())
+	if err != nil {
+		log.Printf("Error on loading role in room %s: %s", room.GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not change message")
+		return nil, nil, false
+	}
+
+	// Don't tell whether messages of other rooms exist
+	if role == "" {
+		client.sendError(message.RequestID, ErrorCodeNoMessage, "message not found")
+		return nil, nil, false
+	}
+
+	if stored.GetSender().GetID() != client.GetID() && role != models.RoleOwner && role != models.RoleModerator {
+		client.sendError(message.RequestID, ErrorCodeForbidden, "only the sender or a moderator may change the message")
+		return nil, nil, false
+	}
+
+	return stored, room, true
+}
+
+// Tells the members of the room on every node about the new state of the message
+func (client *Client) publishMessageUpdate(room *Room, stored models.Message, text string, editedAt *time.Time, deletedAt *time.Time) {
+
+	update := &Message{
+		ID:        stored.GetID(),
+		CreatedAt: stored.GetCreatedAt(),
+		Action:    MessageUpdatedAction,
+		Message:   text,
+		Target:    room,
+		Sender:    stored.GetSender(),
+		EditedAt:  editedAt,
+		DeletedAt: deletedAt,
+	}
+
+	room.publishRoomMessage(update)
+}
@@ -6,5 +6,9 @@ require (
 	github.com/go-redis/redis/v8 v8.3.3
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/websocket v1.4.2
+	github.com/lib/pq v1.8.0
 	github.com/mattn/go-sqlite3 v1.14.4
+	github.com/prometheus/client_golang v1.8.0
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+	gopkg.in/yaml.v2 v2.3.0
 )
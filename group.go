@@ -0,0 +1,238 @@
+package main
+
+import (
+	"log"
+
+	"chat/models"
+
+	"github.com/google/uuid"
+)
+
+// Group rooms are private rooms with an owner, who brings in members by invitation.
+// Invitations are stored, so users who are offline get them on their next connect.
+
+func (client *Client) handleCreateGroupMessage(message Message) {
+
+	name := message.Message
+	if name == "" {
+		client.sendError(message.RequestID, ErrorCodeInvalidMessage, "group name is required")
+		return
+	}
+
+	if isDirectRoomName(name) {
+		client.sendError(message.RequestID, ErrorCodeForbidden, "room name is reserved")
+		return
+	}
+
+	existing, err := client.wsServer.findRoomByName(name)
+	if err != nil {
+		client.sendGroupError(message.RequestID, "could not create group", err)
+		return
+	}
+
+	if existing != nil {
+		client.sendError(message.RequestID, ErrorCodeRoomExists, "room already exists")
+		return
+	}
+
+	room, err := client.wsServer.createRoom(name, true)
+	if err != nil {
+		client.sendGroupError(message.RequestID, "could not create group", err)
+		return
+	}
+
+	if err := client.wsServer.roomRepository.AddRoomMember(ctx, room.GetID(), client.GetID(), models.RoleOwner); err != nil {
+		client.sendGroupError(message.RequestID, "could not create group", err)
+		return
+	}
+
+	if _, err := client.joinRoom(room.GetName(), nil); err != nil {
+		client.sendJoinError(message.RequestID, room.GetName(), err)
+		return
+	}
+
+	client.sendAck(message.RequestID)
+}
+
+// Invites the user with ID in the message text to the target room
+func (client *Client) handleInviteUserMessage(message Message) {
+
+	room, ok := client.findTargetRoom(message)
+	if !ok {
+		return
+	}
+
+	role, err := client.wsServer.roomRepository.GetRoomMemberRole(ctx, room.GetID(), client.GetID())
+	if err != nil {
+		client.sendGroupError(message.RequestID, "could not invite user", err)
+		return
+	}
+
+	if !room.Private || role != models.RoleOwner {
+		client.sendError(message.RequestID, ErrorCodeForbidden, "only the group owner can invite users")
+		return
+	}
+
+	// Offline users are invited too, they get the invitation once they connect
+	invitee, err := client.wsServer.accountRepository.FindAccountByID(ctx, message.Message)
+	if err != nil {
+		client.sendGroupError(message.RequestID, "could not invite user", err)
+		return
+	}
+
+	if invitee == nil {
+		client.sendError(message.RequestID, ErrorCodeUserNotFound, "user not found")
+		return
+	}
+
+	member, err := client.wsServer.roomRepository.IsRoomMember(ctx, room.GetID(), invitee.GetID())
+	if err != nil {
+		client.sendGroupError(message.RequestID, "could not invite user", err)
+		return
+	}
+
+	if member {
+		client.sendError(message.RequestID, ErrorCodeAlreadyMember, "user is already a member")
+		return
+	}
+
+	err = client.wsServer.roomRepository.AddRoomInvitation(ctx, room.GetID(), invitee.GetID(), client.GetID())
+	if err != nil {
+		client.sendGroupError(message.RequestID, "could not invite user", err)
+		return
+	}
+
+	// Like private room invites, the invitee is reached over pub/sub
+	// so it doesn't matter which node it is connected to
+	inviteMessage := &Message{
+		Action:  RoomInviteAction,
+		Message: invitee.GetID(),
+		Target:  room,
+		Sender:  client,
+	}
+
+	if err := client.wsServer.pubSub.Publish(ctx, PubSubGeneralChannel, inviteMessage.encode()); err != nil {
+		log.Println(err)
+	}
+
+	client.sendAck(message.RequestID)
+}
+
+// Accepts the invitation to the room with ID in the message text
+func (client *Client) handleAcceptInviteMessage(message Message) {
+
+	room, ok := client.consumeInvitation(message)
+	if !ok {
+		return
+	}
+
+	if err := client.wsServer.roomRepository.AddRoomMember(ctx, room.GetID(), client.GetID(), models.RoleMember); err != nil {
+		client.sendGroupError(message.RequestID, "could not accept invitation", err)
+		return
+	}
+
+	if _, err := client.joinRoom(room.GetName(), nil); err != nil {
+		client.sendJoinError(message.RequestID, room.GetName(), err)
+		return
+	}
+
+	client.sendAck(message.RequestID)
+}
+
+// Declines the invitation to the room with ID in the message text
+func (client *Client) handleDeclineInviteMessage(message Message) {
+
+	if _, ok := client.consumeInvitation(message); !ok {
+		return
+	}
+
+	client.sendAck(message.RequestID)
+}
+
+// Removes the pending invitation, returns false after telling the client what went wrong
+func (client *Client) consumeInvitation(message Message) (*Room, bool) {
+
+	room, err := client.wsServer.findRoomByID(message.Message)
+	if err != nil {
+		client.sendGroupError(message.RequestID, "could not answer invitation", err)
+		return nil, false
+	}
+
+	if room == nil {
+		client.sendError(message.RequestID, ErrorCodeRoomNotFound, "room not found")
+		return nil, false
+	}
+
+	removed, err := client.wsServer.roomRepository.RemoveRoomInvitation(ctx, room.GetID(), client.GetID())
+	if err != nil {
+		client.sendGroupError(message.RequestID, "could not answer invitation", err)
+		return nil, false
+	}
+
+	if !removed {
+		client.sendError(message.RequestID, ErrorCodeNoInvitation, "no invitation to this room")
+		return nil, false
+	}
+
+	return room, true
+}
+
+// Finds the room the message targets, returns false after telling the client what went wrong
+func (client *Client) findTargetRoom(message Message) (*Room, bool) {
+
+	if message.Target == nil {
+		client.sendError(message.RequestID, ErrorCodeRoomNotFound, "room not found")
+		return nil, false
+	}
+
+	room, err := client.wsServer.findRoomByID(message.Target.GetID())
+	if err != nil {
+		client.sendGroupError(message.RequestID, "could not find room", err)
+		return nil, false
+	}
+
+	if room == nil {
+		client.sendError(message.RequestID, ErrorCodeRoomNotFound, "room not found")
+		return nil, false
+	}
+
+	return room, true
+}
+
+func (client *Client) sendGroupError(requestID string, text string, err error) {
+	log.Printf("Error on handling group request of %s: %s", client.GetID(), err)
+	client.sendError(requestID, ErrorCodeInternal, text)
+}
+
+// Forwards an invitation from pub/sub to the invited client
+func (server *WsServer) handleRoomInvite(message Message) {
+
+	for _, targetClient := range server.findClientsByID(message.Message) {
+		targetClient.sendMessage(&message)
+	}
+}
+
+func (server *WsServer) sendPendingInvitations(client *Client) {
+
+	invitations, err := server.roomRepository.GetUserInvitations(ctx, client.GetID())
+	if err != nil {
+		log.Printf("Error on loading invitations of %s: %s", client.GetID(), err)
+		return
+	}
+
+	for _, invitation := range invitations {
+		room := &Room{
+			Name:    invitation.GetRoom().GetName(),
+			Private: invitation.GetRoom().GetPrivate(),
+		}
+		room.ID, _ = uuid.Parse(invitation.GetRoom().GetID())
+
+		message := &Message{
+			Action:  RoomInviteAction,
+			Message: client.GetID(),
+			Target:  room,
+			Sender:  invitation.GetInvitedBy(),
+		}
+		client.sendMessage(message)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"chat/pubsub"
+)
+
+// Max time the readiness checks may take together
+const readinessTimeout = 2 * time.Second
+
+// Health serves the liveness and readiness endpoints
+type Health struct {
+	Db       *sql.DB
+	PubSub   pubsub.PubSub
+	WsServer *WsServer
+}
+
+// ReadinessResponse lists the result of every readiness check
+type ReadinessResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// HandleHealthz only reports that the process is alive
+func (health *Health) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// HandleReadyz reports whether this node should receive traffic, it turns
+// unready as soon as the server starts draining
+func (health *Health) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	response := &ReadinessResponse{
+		Ready:  true,
+		Checks: make(map[string]string),
+	}
+	check := func(name string, err error) {
+		if err != nil {
+			response.Ready = false
+			response.Checks[name] = err.Error()
+			return
+		}
+		response.Checks[name] = "ok"
+	}
+
+	if health.WsServer.Draining() {
+		response.Ready = false
+		response.Checks["server"] = "draining"
+	} else {
+		response.Checks["server"] = "ok"
+	}
+
+	var one int
+	check("database", health.Db.QueryRowContext(ctx, "SELECT 1").Scan(&one))
+	check("pubsub", health.PubSub.Ping(ctx))
+
+	w.Header().Set("Content-Type", "application/json")
+	if !response.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Println(err)
+	}
+}
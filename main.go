@@ -1,37 +1,177 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"chat/auth"
 	"chat/config"
-	"chat/repository"
+	"chat/metrics"
+	"chat/migrations"
+	"chat/presence"
+	"chat/pubsub"
+	"chat/session"
 )
 
-var addr = flag.String("addr", ":8080", "http server address")
+var configPath = flag.String("config", os.Getenv("CHAT_CONFIG"), "path of the yaml config file, environment variables override it")
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate up|down [steps]|status]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
 
 func main() {
 
 	flag.Parse()
 
-	db := config.InitDB()
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := config.InitDB(cfg.Database.Driver, cfg.Database.DSN)
 	defer db.Close()
 
-	config.CreateRedisClient()
+	migrator, err := migrations.NewMigrator(db, cfg.Database.Driver)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(migrator, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cfg.Database.AutoMigrate {
+		if err := migrateUp(migrator); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	policy, err := ParseSlowConsumerPolicy(cfg.Websocket.SlowConsumerPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	secret := []byte(cfg.Auth.Secret)
+	if len(secret) == 0 {
+		log.Println("No auth secret set, tokens won't survive a restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal(err)
+		}
+	}
+	auth.SetSecret(secret)
+
+	// Presence and sessions live next to pub/sub, all have to be shared by all nodes
+	var pubSub pubsub.PubSub
+	var presenceStore presence.Store
+	var sessionStore session.Store
+	switch cfg.PubSub {
+	case "redis":
+		config.CreateRedisClient(cfg.Redis.URL)
+		pubSub = pubsub.NewRedis(config.Redis)
+		presenceStore = presence.NewRedis(config.Redis)
+		sessionStore = session.NewRedis(config.Redis)
+	case "memory":
+		pubSub = pubsub.NewMemory()
+		presenceStore = presence.NewMemory()
+		sessionStore = session.NewMemory()
+	default:
+		log.Fatalf("Unknown pub/sub backend %q", cfg.PubSub)
+	}
+	pubSub = pubsub.NewInstrumented(pubSub, cfg.PubSub)
+	defer pubSub.Close()
 
-	wsServer := NewWebsocketServer(
-		&repository.RoomRepository{Db: db},
-		&repository.UserRepository{Db: db},
-	)
+	repositories := newRepositories(cfg.Database.Driver, db)
+
+	options := ServerOptions{
+		RoomIdleTimeout:    cfg.Rooms.IdleTimeout,
+		Websocket:          cfg.Websocket,
+		SlowConsumerPolicy: policy,
+		PresenceTTL:        cfg.Presence.TTL,
+		HeartbeatInterval:  cfg.Presence.HeartbeatInterval,
+		SessionGracePeriod: cfg.Session.GracePeriod,
+	}
+
+	wsServer, err := NewWebsocketServer(options, pubSub, presenceStore, sessionStore, repositories.rooms, repositories.messages, repositories.accounts)
+	if err != nil {
+		log.Fatal(err)
+	}
 	go wsServer.Run()
 
+	api := &API{
+		AccountRepository: repositories.accounts,
+		RoomRepository:    repositories.rooms,
+		Presence:          presenceStore,
+		MessageRepository: repositories.messages,
+		WsServer:          wsServer,
+	}
+	http.HandleFunc("/login", api.HandleLogin)
+	http.HandleFunc("/register", api.HandleRegister)
+	http.HandleFunc("/api/rooms", api.Authenticated(api.HandleRooms))
+	http.HandleFunc("/api/rooms/", api.Authenticated(api.HandleRoom))
+	http.HandleFunc("/api/users/online", api.Authenticated(api.HandleOnlineUsers))
+	http.HandleFunc("/api/stats", api.Authenticated(api.HandleStats))
+
+	health := &Health{
+		Db:       db,
+		PubSub:   pubSub,
+		WsServer: wsServer,
+	}
+	http.HandleFunc("/healthz", health.HandleHealthz)
+	http.HandleFunc("/readyz", health.HandleReadyz)
+	http.Handle("/metrics", metrics.Handler())
+
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		ServeWs(wsServer, w, r)
 	})
 
-	fs := http.FileServer(http.Dir("./public"))
+	fs := http.FileServer(http.Dir(cfg.StaticDir))
 	http.Handle("/", fs)
 
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	server := &http.Server{Addr: cfg.Addr}
+	go func() {
+		var err error
+		if cfg.TLS.Enabled() {
+			err = server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+
+	log.Println("Shutting down")
+	// Give load balancers time to see the node unready before closing connections
+	wsServer.StartDraining()
+	time.Sleep(cfg.DrainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Websocket connections are hijacked, so http.Server.Shutdown doesn't wait for them
+	if err := wsServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error on closing websocket connections %s", err)
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error on shutting down http server %s", err)
+	}
 }
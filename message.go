@@ -4,6 +4,9 @@ import (
 	"chat/models"
 	"encoding/json"
 	"log"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 const (
@@ -14,14 +17,80 @@ const (
 	UserLeftAction        = "user-left"
 	JoinRoomPrivateAction = "join-room-private"
 	RoomJoinedAction      = "room-joined"
+	ErrorAction           = "error"
+	AckAction             = "ack"
+	CreateGroupAction     = "create-group"
+	InviteUserAction      = "invite-user"
+	RoomInviteAction      = "room-invite"
+	AcceptInviteAction    = "accept-invite"
+	DeclineInviteAction   = "decline-invite"
+	SessionAction         = "session"
+	RoomLeftAction        = "room-left"
+	TypingAction          = "typing"
+	MarkReadAction        = "mark-read"
+	EditMessageAction     = "edit-message"
+	DeleteMessageAction   = "delete-message"
+	MessageUpdatedAction  = "message-updated"
+	MessageReadAction     = "message-read"
+	UnreadAction          = "unread"
+	PromoteMemberAction   = "promote-member"
+	DemoteMemberAction    = "demote-member"
+	// Not all missed messages were replayed, older ones are fetched before the message with the ID
+	HistoryTruncatedAction = "history-truncated"
+	// Tell the nodes a user joined or left a room, so all its connections follow
+	MemberJoinedAction = "member-joined"
+	MemberLeftAction   = "member-left"
+)
+
+// Actions clients may send, anything else is counted as unknown
+var clientActions = map[string]bool{
+	SendMessageAction:     true,
+	JoinRoomAction:        true,
+	LeaveRoomAction:       true,
+	JoinRoomPrivateAction: true,
+	CreateGroupAction:     true,
+	InviteUserAction:      true,
+	AcceptInviteAction:    true,
+	DeclineInviteAction:   true,
+	TypingAction:          true,
+	MarkReadAction:        true,
+	EditMessageAction:     true,
+	DeleteMessageAction:   true,
+	PromoteMemberAction:   true,
+	DemoteMemberAction:    true,
+}
+
+// Error codes sent along with ErrorAction
+const (
+	ErrorCodeInvalidMessage = "invalid-message"
+	ErrorCodeUnknownAction  = "unknown-action"
+	ErrorCodeRoomNotFound   = "room-not-found"
+	ErrorCodeUserNotFound   = "user-not-found"
+	ErrorCodeNotAMember     = "not-a-member"
+	ErrorCodeForbidden      = "forbidden"
+	ErrorCodeRateLimited    = "rate-limited"
+	ErrorCodeRoomExists     = "room-exists"
+	ErrorCodeAlreadyMember  = "already-a-member"
+	ErrorCodeNoInvitation   = "invitation-not-found"
+	ErrorCodeNoSession      = "session-not-found"
+	ErrorCodeNoMessage      = "message-not-found"
+	ErrorCodeInternal       = "internal-error"
 )
 
 // Message ...
 type Message struct {
-	Action  string      `json:"action"`
-	Message string      `json:"message"`
-	Target  *Room       `json:"target"`
-	Sender  models.User `json:"sender"`
+	ID        string      `json:"id,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Action    string      `json:"action"`
+	Code      string      `json:"code,omitempty"`
+	Message   string      `json:"message"`
+	Target    *Room       `json:"target"`
+	Sender    models.User `json:"sender"`
+	EditedAt  *time.Time  `json:"editedAt,omitempty"`
+	DeletedAt *time.Time  `json:"deletedAt,omitempty"`
+	// Number of unread messages in the target room
+	Unread int `json:"unread,omitempty"`
 }
 
 // UnmarshalJSON ...
@@ -29,7 +98,7 @@ func (message *Message) UnmarshalJSON(data []byte) error {
 
 	type Alias Message
 	msg := &struct {
-		Sender Client `json:"sender"`
+		Sender *Client `json:"sender"`
 		*Alias
 	}{
 		Alias: (*Alias)(message),
@@ -39,11 +108,61 @@ func (message *Message) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	message.Sender = &msg.Sender
+	// Keep a missing sender nil rather than a nil *Client
+	if msg.Sender != nil {
+		message.Sender = msg.Sender
+	}
 
 	return nil
 }
 
+// GetID returns message id
+func (message *Message) GetID() string {
+	return message.ID
+}
+
+// GetCreatedAt returns time the server accepted the message
+func (message *Message) GetCreatedAt() time.Time {
+	return message.CreatedAt
+}
+
+// GetMessage returns message text
+func (message *Message) GetMessage() string {
+	return message.Message
+}
+
+// GetTarget returns room the message was sent to
+func (message *Message) GetTarget() models.Room {
+	if message.Target == nil {
+		return nil
+	}
+	return message.Target
+}
+
+// GetSender returns user who sent the message
+func (message *Message) GetSender() models.User {
+	return message.Sender
+}
+
+// GetEditedAt returns when the message was last edited, nil if never
+func (message *Message) GetEditedAt() *time.Time {
+	return message.EditedAt
+}
+
+// GetDeletedAt returns when the message was deleted, nil if it wasn't
+func (message *Message) GetDeletedAt() *time.Time {
+	return message.DeletedAt
+}
+
+// stamp makes the message a new one, whatever the client claimed about it
+func (message *Message) stamp() {
+	message.ID = uuid.New().String()
+	message.CreatedAt = time.Now().UTC()
+	message.EditedAt = nil
+	message.DeletedAt = nil
+	message.Unread = 0
+}
+
 func (message *Message) encode() []byte {
 
 	json, err := json.Marshal(message)
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chat"
+
+var (
+	// ConnectedClients is the number of websocket clients connected to this node
+	ConnectedClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connected_clients",
+		Help:      "Number of websocket clients connected to this node.",
+	})
+
+	// LoadedRooms is the number of rooms running on this node
+	LoadedRooms = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "loaded_rooms",
+		Help:      "Number of rooms running on this node.",
+	})
+
+	// MessagesReceived counts messages read from clients by action
+	MessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Messages received from clients by action.",
+	}, []string{"action"})
+
+	// MessagesSent counts messages queued for clients by action
+	MessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_sent_total",
+		Help:      "Messages queued for clients by action.",
+	}, []string{"action"})
+
+	// PublishErrors counts failed pub/sub publishes by backend
+	PublishErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pubsub_publish_errors_total",
+		Help:      "Failed pub/sub publishes by backend.",
+	}, []string{"backend"})
+
+	// PublishDuration observes pub/sub publish latency by backend
+	PublishDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pubsub_publish_duration_seconds",
+		Help:      "Latency of pub/sub publishes by backend.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"backend"})
+
+	// QueryDuration observes repository query latency by query
+	QueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "repository_query_duration_seconds",
+		Help:      "Latency of repository queries by query.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"query"})
+
+	// UpgradeFailures counts rejected websocket connections by reason
+	UpgradeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_upgrade_failures_total",
+		Help:      "Rejected websocket connections by reason.",
+	}, []string{"reason"})
+)
+
+// NewCounterFunc registers a counter whose value is read from function on every scrape
+func NewCounterFunc(name string, help string, function func() float64) {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, function)
+}
+
+// ObserveQuery records the latency of a repository query started at start,
+// use as defer metrics.ObserveQuery("name", time.Now())
+func ObserveQuery(query string, start time.Time) {
+	QueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,190 @@
+package migrations
+
+import (
+	"chat/repository"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration changes the schema from the previous version to Version
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status tells whether a migration was applied and when
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies migrations in order of their versions, every migration
+// runs in its own transaction together with its schema_migrations row
+type Migrator struct {
+	db         *sql.DB
+	driver     string
+	migrations []Migration
+}
+
+// NewMigrator creates a migrator for the db opened with driver, sqlite3 or postgres
+func NewMigrator(db *sql.DB, driver string) (*Migrator, error) {
+
+	var migrations []Migration
+	switch driver {
+	case "sqlite3":
+		migrations = SQLite
+	case "postgres":
+		migrations = Postgres
+	default:
+		return nil, fmt.Errorf("no migrations for database driver %q", driver)
+	}
+
+	return &Migrator{db: db, driver: driver, migrations: migrations}, nil
+}
+
+// Up applies all pending migrations and returns them
+func (migrator *Migrator) Up(ctx context.Context) ([]Migration, error) {
+
+	applied, err := migrator.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make([]Migration, 0)
+	for _, migration := range migrator.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		err := migrator.inTransaction(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(
+				ctx,
+				migrator.rebind("INSERT INTO schema_migrations(version, name, applied_at) VALUES (?, ?, ?)"),
+				migration.Version,
+				migration.Name,
+				time.Now().UTC(),
+			)
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d %s: %s", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+// Down reverts the last steps applied migrations and returns them
+func (migrator *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+
+	applied, err := migrator.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make([]Migration, 0)
+	for i := len(migrator.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := migrator.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		err := migrator.inTransaction(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, migrator.rebind("DELETE FROM schema_migrations WHERE version = ?"), migration.Version)
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d %s: %s", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+// Status lists every known migration
+func (migrator *Migrator) Status(ctx context.Context) ([]Status, error) {
+
+	applied, err := migrator.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(migrator.migrations))
+	for _, migration := range migrator.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, Status{
+			Migration: migration,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+
+	return statuses, nil
+}
+
+// Returns the applied versions with the time they were applied
+func (migrator *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+
+	_, err := migrator.db.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)`,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := migrator.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// Postgres numbers its placeholders
+func (migrator *Migrator) rebind(query string) string {
+	return repository.Rebind(migrator.driver, query)
+}
+
+func (migrator *Migrator) inTransaction(ctx context.Context, run func(tx *sql.Tx) error) error {
+
+	tx, err := migrator.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := run(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,102 @@
+package migrations
+
+// Postgres migrations, keep the versions in step with the SQLite ones
+var Postgres = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: `
+		CREATE TABLE room (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			private BOOLEAN NOT NULL DEFAULT FALSE
+		);
+		CREATE UNIQUE INDEX room_name ON room (name);
+
+		CREATE TABLE room_member (
+			room_id VARCHAR(255) NOT NULL,
+			user_id VARCHAR(255) NOT NULL,
+			role VARCHAR(32) NOT NULL DEFAULT 'member',
+			PRIMARY KEY (room_id, user_id)
+		);
+
+		CREATE TABLE room_invitation (
+			room_id VARCHAR(255) NOT NULL,
+			user_id VARCHAR(255) NOT NULL,
+			invited_by VARCHAR(255) NOT NULL,
+			PRIMARY KEY (room_id, user_id)
+		);
+
+		CREATE TABLE "user" (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL
+		);
+
+		CREATE TABLE account (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			username VARCHAR(255) NOT NULL UNIQUE,
+			password VARCHAR(255) NOT NULL
+		);
+
+		CREATE TABLE message (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			room_id VARCHAR(255) NOT NULL,
+			sender_id VARCHAR(255) NOT NULL,
+			sender_name VARCHAR(255) NOT NULL,
+			message TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX message_room_id_created_at ON message (room_id, created_at);
+		`,
+		Down: `
+		DROP TABLE message;
+		DROP TABLE account;
+		DROP TABLE "user";
+		DROP TABLE room_invitation;
+		DROP TABLE room_member;
+		DROP TABLE room;
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "move presence out of the database",
+		Up: `
+		DROP TABLE "user";
+		`,
+		Down: `
+		CREATE TABLE "user" (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL
+		);
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "read cursors",
+		Up: `
+		CREATE TABLE room_read (
+			room_id VARCHAR(255) NOT NULL,
+			user_id VARCHAR(255) NOT NULL,
+			message_id VARCHAR(255) NOT NULL,
+			message_created_at TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (room_id, user_id)
+		);
+		`,
+		Down: `
+		DROP TABLE room_read;
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "message edits",
+		Up: `
+		ALTER TABLE message ADD COLUMN edited_at TIMESTAMPTZ NULL;
+		ALTER TABLE message ADD COLUMN deleted_at TIMESTAMPTZ NULL;
+		`,
+		Down: `
+		ALTER TABLE message DROP COLUMN deleted_at;
+		ALTER TABLE message DROP COLUMN edited_at;
+		`,
+	},
+}
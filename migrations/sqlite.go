@@ -0,0 +1,115 @@
+package migrations
+
+// SQLite migrations, append new ones with the next version and never edit applied ones
+var SQLite = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		// IF NOT EXISTS adopts databases created before migrations existed
+		Up: `
+		CREATE TABLE IF NOT EXISTS room (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			private TINYINT NULL
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS room_name ON room (name);
+
+		CREATE TABLE IF NOT EXISTS room_member (
+			room_id VARCHAR(255) NOT NULL,
+			user_id VARCHAR(255) NOT NULL,
+			role VARCHAR(32) NOT NULL DEFAULT 'member',
+			PRIMARY KEY (room_id, user_id)
+		);
+
+		CREATE TABLE IF NOT EXISTS room_invitation (
+			room_id VARCHAR(255) NOT NULL,
+			user_id VARCHAR(255) NOT NULL,
+			invited_by VARCHAR(255) NOT NULL,
+			PRIMARY KEY (room_id, user_id)
+		);
+
+		CREATE TABLE IF NOT EXISTS user (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS account (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			username VARCHAR(255) NOT NULL UNIQUE,
+			password VARCHAR(255) NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS message (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			room_id VARCHAR(255) NOT NULL,
+			sender_id VARCHAR(255) NOT NULL,
+			sender_name VARCHAR(255) NOT NULL,
+			message TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS message_room_id_created_at ON message (room_id, created_at);
+		`,
+		Down: `
+		DROP TABLE message;
+		DROP TABLE account;
+		DROP TABLE user;
+		DROP TABLE room_invitation;
+		DROP TABLE room_member;
+		DROP TABLE room;
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "move presence out of the database",
+		Up: `
+		DROP TABLE user;
+		`,
+		Down: `
+		CREATE TABLE user (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL
+		);
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "read cursors",
+		Up: `
+		CREATE TABLE room_read (
+			room_id VARCHAR(255) NOT NULL,
+			user_id VARCHAR(255) NOT NULL,
+			message_id VARCHAR(255) NOT NULL,
+			message_created_at DATETIME NOT NULL,
+			PRIMARY KEY (room_id, user_id)
+		);
+		`,
+		Down: `
+		DROP TABLE room_read;
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "message edits",
+		Up: `
+		ALTER TABLE message ADD COLUMN edited_at DATETIME NULL;
+		ALTER TABLE message ADD COLUMN deleted_at DATETIME NULL;
+		`,
+		// SQLite can't drop columns before 3.35, so the table is copied without them
+		Down: `
+		CREATE TABLE message_before_edits (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			room_id VARCHAR(255) NOT NULL,
+			sender_id VARCHAR(255) NOT NULL,
+			sender_name VARCHAR(255) NOT NULL,
+			message TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		);
+		INSERT INTO message_before_edits (id, room_id, sender_id, sender_name, message, created_at)
+		SELECT id, room_id, sender_id, sender_name, message, created_at FROM message;
+		DROP TABLE message;
+		ALTER TABLE message_before_edits RENAME TO message;
+		CREATE INDEX message_room_id_created_at ON message (room_id, created_at);
+		`,
+	},
+}
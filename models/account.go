@@ -0,0 +1,18 @@
+package models
+
+import "context"
+
+// Account ...
+type Account interface {
+	GetID() string
+	GetName() string
+	GetUsername() string
+	GetPassword() string
+}
+
+// AccountRepository ...
+type AccountRepository interface {
+	AddAccount(ctx context.Context, account Account) error
+	FindAccountByUsername(ctx context.Context, username string) (Account, error)
+	FindAccountByID(ctx context.Context, id string) (Account, error)
+}
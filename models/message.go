@@ -0,0 +1,29 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Message ...
+type Message interface {
+	GetID() string
+	GetCreatedAt() time.Time
+	GetMessage() string
+	GetTarget() Room
+	GetSender() User
+	GetEditedAt() *time.Time
+	GetDeletedAt() *time.Time
+}
+
+// MessageRepository ...
+type MessageRepository interface {
+	AddMessage(ctx context.Context, message Message) error
+	GetRoomMessages(ctx context.Context, roomID string, before string, limit int) ([]Message, error)
+	FindMessageByID(ctx context.Context, id string) (Message, error)
+	GetRoomMessagesSince(ctx context.Context, roomID string, since time.Time, limit int) ([]Message, error)
+	MarkRead(ctx context.Context, roomID string, userID string, message Message) (bool, error)
+	GetUnreadCounts(ctx context.Context, userID string) (map[string]int, error)
+	EditMessage(ctx context.Context, id string, text string, editedAt time.Time) (bool, error)
+	DeleteMessage(ctx context.Context, id string, deletedAt time.Time) (bool, error)
+}
@@ -1,5 +1,14 @@
 package models
 
+import "context"
+
+// Member roles in a room, owners and moderators may edit and delete messages of other members
+const (
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
 // Room ...
 type Room interface {
 	GetID() string
@@ -9,6 +18,24 @@ type Room interface {
 
 // RoomRepository ...
 type RoomRepository interface {
-	AddRoom(room Room)
-	FindRoomByName(name string) Room
+	AddRoom(ctx context.Context, room Room) error
+	FindRoomByName(ctx context.Context, name string) (Room, error)
+	FindRoomByID(ctx context.Context, id string) (Room, error)
+	GetPublicRooms(ctx context.Context) ([]Room, error)
+	GetUserRooms(ctx context.Context, userID string) ([]Room, error)
+	GetRoomMembers(ctx context.Context, roomID string) ([]User, error)
+	AddRoomMember(ctx context.Context, roomID string, userID string, role string) error
+	RemoveRoomMember(ctx context.Context, roomID string, userID string) error
+	IsRoomMember(ctx context.Context, roomID string, userID string) (bool, error)
+	GetRoomMemberRole(ctx context.Context, roomID string, userID string) (string, error)
+	SetRoomMemberRole(ctx context.Context, roomID string, userID string, role string) (bool, error)
+	AddRoomInvitation(ctx context.Context, roomID string, userID string, invitedBy string) error
+	RemoveRoomInvitation(ctx context.Context, roomID string, userID string) (bool, error)
+	GetUserInvitations(ctx context.Context, userID string) ([]Invitation, error)
+}
+
+// Invitation to a private room
+type Invitation interface {
+	GetRoom() Room
+	GetInvitedBy() User
 }
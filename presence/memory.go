@@ -0,0 +1,129 @@
+package presence
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"chat/models"
+)
+
+// Memory in-process presence, for running a single node without redis
+type Memory struct {
+	mu          sync.Mutex
+	connections map[string]*memoryConnection
+	// live connection count by user id
+	users map[string]int
+}
+
+type memoryConnection struct {
+	user      models.User
+	expiresAt time.Time
+}
+
+// NewMemory creates in-process presence
+func NewMemory() *Memory {
+	return &Memory{
+		connections: make(map[string]*memoryConnection),
+		users:       make(map[string]int),
+	}
+}
+
+// Connect adds the connection of the user
+func (store *Memory) Connect(ctx context.Context, connectionID string, user models.User, ttl time.Duration) (bool, error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if connection, ok := store.connections[connectionID]; ok {
+		connection.expiresAt = time.Now().Add(ttl)
+		return false, nil
+	}
+
+	store.connections[connectionID] = &memoryConnection{user: user, expiresAt: time.Now().Add(ttl)}
+	store.users[user.GetID()]++
+
+	return store.users[user.GetID()] == 1, nil
+}
+
+// Refresh extends the ttl of live connections
+func (store *Memory) Refresh(ctx context.Context, connectionIDs []string, ttl time.Duration) error {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, connectionID := range connectionIDs {
+		if connection, ok := store.connections[connectionID]; ok {
+			connection.expiresAt = time.Now().Add(ttl)
+		}
+	}
+
+	return nil
+}
+
+// Disconnect removes the connection
+func (store *Memory) Disconnect(ctx context.Context, connectionID string) (bool, error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	connection, ok := store.connections[connectionID]
+	if !ok {
+		return false, nil
+	}
+
+	return store.remove(connectionID, connection), nil
+}
+
+// Expire removes connections past their ttl
+func (store *Memory) Expire(ctx context.Context) ([]models.User, error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	left := make([]models.User, 0)
+	now := time.Now()
+	for connectionID, connection := range store.connections {
+		if connection.expiresAt.After(now) {
+			continue
+		}
+		if store.remove(connectionID, connection) {
+			left = append(left, connection.user)
+		}
+	}
+
+	return left, nil
+}
+
+// Online lists users with at least one live connection
+func (store *Memory) Online(ctx context.Context) ([]models.User, error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	users := make([]models.User, 0, len(store.users))
+	seen := make(map[string]bool)
+	for _, connection := range store.connections {
+		if !seen[connection.user.GetID()] {
+			seen[connection.user.GetID()] = true
+			users = append(users, connection.user)
+		}
+	}
+
+	return users, nil
+}
+
+// Returns true if it was the last connection of the user, store.mu must be held
+func (store *Memory) remove(connectionID string, connection *memoryConnection) bool {
+
+	delete(store.connections, connectionID)
+
+	userID := connection.user.GetID()
+	store.users[userID]--
+	if store.users[userID] > 0 {
+		return false
+	}
+
+	delete(store.users, userID)
+	return true
+}
@@ -0,0 +1,27 @@
+package presence
+
+import (
+	"context"
+	"time"
+
+	"chat/models"
+)
+
+// Store tracks the connections of online users for all nodes. Every
+// connection expires after its ttl unless its node keeps refreshing it,
+// so users of a crashed node go offline on their own.
+type Store interface {
+	// Connect adds the connection of the user, returns true if it's the
+	// first live connection of the user
+	Connect(ctx context.Context, connectionID string, user models.User, ttl time.Duration) (bool, error)
+	// Refresh extends the ttl of live connections
+	Refresh(ctx context.Context, connectionIDs []string, ttl time.Duration) error
+	// Disconnect removes the connection, returns true if it was the last
+	// live connection of the user
+	Disconnect(ctx context.Context, connectionID string) (bool, error)
+	// Expire removes connections past their ttl and returns the users
+	// left without a live connection
+	Expire(ctx context.Context) ([]models.User, error)
+	// Online lists users with at least one live connection
+	Online(ctx context.Context) ([]models.User, error)
+}
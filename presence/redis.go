@@ -0,0 +1,205 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"chat/models"
+	"chat/repository"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// Sorted set of connection ids scored by their expiry in unix milliseconds
+	connectionsKey = "presence:connections"
+	// Hash of connection id to the json encoded user
+	connectionUsersKey = "presence:connection-users"
+	// Set of connection ids of a user, followed by the user id
+	userConnectionsKeyPrefix = "presence:user:"
+)
+
+// Redis presence shared by all chat nodes
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis creates redis backed presence
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{client: client}
+}
+
+// Connect adds the connection of the user
+func (store *Redis) Connect(ctx context.Context, connectionID string, user models.User, ttl time.Duration) (bool, error) {
+
+	encoded, err := json.Marshal(&repository.User{ID: user.GetID(), Name: user.GetName()})
+	if err != nil {
+		return false, err
+	}
+
+	var count *redis.IntCmd
+	_, err = store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, connectionsKey, &redis.Z{Score: expiry(ttl), Member: connectionID})
+		pipe.HSet(ctx, connectionUsersKey, connectionID, encoded)
+		pipe.SAdd(ctx, userConnectionsKey(user.GetID()), connectionID)
+		count = pipe.SCard(ctx, userConnectionsKey(user.GetID()))
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return count.Val() == 1, nil
+}
+
+// Refresh extends the ttl of live connections
+func (store *Redis) Refresh(ctx context.Context, connectionIDs []string, ttl time.Duration) error {
+
+	if len(connectionIDs) == 0 {
+		return nil
+	}
+
+	members := make([]*redis.Z, 0, len(connectionIDs))
+	for _, connectionID := range connectionIDs {
+		members = append(members, &redis.Z{Score: expiry(ttl), Member: connectionID})
+	}
+
+	// XX only updates, a connection expired meanwhile stays gone
+	return store.client.ZAddXX(ctx, connectionsKey, members...).Err()
+}
+
+// Disconnect removes the connection
+func (store *Redis) Disconnect(ctx context.Context, connectionID string) (bool, error) {
+
+	_, last, err := store.remove(ctx, connectionID)
+	return last, err
+}
+
+// Expire removes connections past their ttl
+func (store *Redis) Expire(ctx context.Context) ([]models.User, error) {
+
+	expired, err := store.client.ZRangeByScore(ctx, connectionsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatFloat(expiry(0), 'f', 0, 64),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	left := make([]models.User, 0)
+	for _, connectionID := range expired {
+		user, last, err := store.remove(ctx, connectionID)
+		if err != nil {
+			return left, err
+		}
+		if last {
+			left = append(left, user)
+		}
+	}
+
+	return left, nil
+}
+
+// Online lists users with at least one live connection
+func (store *Redis) Online(ctx context.Context) ([]models.User, error) {
+
+	connectionIDs, err := store.client.ZRangeByScore(ctx, connectionsKey, &redis.ZRangeBy{
+		Min: strconv.FormatFloat(expiry(0), 'f', 0, 64),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]models.User, 0)
+	if len(connectionIDs) == 0 {
+		return users, nil
+	}
+
+	values, err := store.client.HMGet(ctx, connectionUsersKey, connectionIDs...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, value := range values {
+		encoded, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var user repository.User
+		if err := json.Unmarshal([]byte(encoded), &user); err != nil {
+			return nil, err
+		}
+		if !seen[user.ID] {
+			seen[user.ID] = true
+			users = append(users, &user)
+		}
+	}
+
+	return users, nil
+}
+
+// Removes the connection from the sorted set, the hash and the set of its user in one step,
+// so a failure or a crash can't leave the user online without a connection that expires.
+// Returns nil if the connection was already removed, otherwise the encoded user and
+// the number of connections the user has left.
+var removeScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return false
+end
+local encoded = redis.call('HGET', KEYS[2], ARGV[1])
+if not encoded then
+	return false
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+local userKey = ARGV[2] .. cjson.decode(encoded).id
+redis.call('SREM', userKey, ARGV[1])
+return {encoded, redis.call('SCARD', userKey)}
+`)
+
+// Only the node which removes the connection from the sorted set goes on,
+// so a user left without connections is reported once
+func (store *Redis) remove(ctx context.Context, connectionID string) (models.User, bool, error) {
+
+	result, err := removeScript.Run(
+		ctx,
+		store.client,
+		[]string{connectionsKey, connectionUsersKey},
+		connectionID,
+		userConnectionsKeyPrefix,
+	).Result()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	removed, ok := result.([]interface{})
+	if !ok || len(removed) != 2 {
+		return nil, false, fmt.Errorf("unexpected result of removing connection %s: %v", connectionID, result)
+	}
+
+	encoded, _ := removed[0].(string)
+	count, _ := removed[1].(int64)
+
+	var user repository.User
+	if err := json.Unmarshal([]byte(encoded), &user); err != nil {
+		return nil, false, err
+	}
+
+	return &user, count == 0, nil
+}
+
+func userConnectionsKey(userID string) string {
+	return userConnectionsKeyPrefix + userID
+}
+
+// Unix milliseconds ttl from now
+func expiry(ttl time.Duration) float64 {
+	return float64(time.Now().Add(ttl).UnixNano() / int64(time.Millisecond))
+}
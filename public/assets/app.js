@@ -4,10 +4,21 @@ var app = new Vue({
     ws: null,
     serverUrl: "ws://" + location.host + "/ws",
     roomInput: null,
+    groupInput: null,
+    invitations: [],
     rooms: [],
     user: {
-      name: ""
+      username: "",
+      id: "",
+      password: "",
+      token: ""
     },
+    loginError: "",
+    serverError: "",
+    requestCounter: 0,
+    // Resumes rooms and missed messages when the connection drops
+    session: "",
+    lastMessage: null,
     users: []
   },
   mounted: function () {
@@ -15,20 +26,64 @@ var app = new Vue({
   },
   methods: {
 
-    connect() {
-      this.connectToWebsocket();
+    login() {
+      this.authenticate("/login");
+    },
+
+    register() {
+      this.authenticate("/register");
+    },
+
+    authenticate(url) {
+      fetch(url, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ username: this.user.username, password: this.user.password })
+      })
+        .then((response) => {
+          if (!response.ok) {
+            return response.text().then((text) => { throw new Error(text); });
+          }
+          return response.json();
+        })
+        .then((data) => {
+          this.loginError = "";
+          this.user.token = data.token;
+          this.user.id = data.user.id;
+          this.user.password = "";
+          this.connectToWebsocket();
+        })
+        .catch((error) => {
+          this.loginError = error.message;
+        });
     },
 
     connectToWebsocket() {
-      this.ws = new WebSocket(this.serverUrl + "?name=" + this.user.name);
+      let url = this.serverUrl + "?bearer=" + this.user.token;
+      if (this.session) {
+        url += "&session=" + encodeURIComponent(this.session);
+        if (this.lastMessage) {
+          url += "&lastMessageId=" + this.lastMessage.id;
+        }
+      }
+      this.ws = new WebSocket(url);
       this.ws.addEventListener('open', (event) => { this.onWebsocketOpen(event) });
       this.ws.addEventListener('message', (event) => { this.handleNewMessage(event) });
+      this.ws.addEventListener('close', (event) => { this.onWebsocketClose(event) });
     },
 
     onWebsocketOpen() {
       console.log("connected to WS!");
     },
 
+    onWebsocketClose(event) {
+      this.serverError = "Disconnected" + (event.reason ? ": " + event.reason : "");
+      // Reconnect within the grace period of the server to pick up where we left off
+      if (this.session) {
+        setTimeout(() => { this.connectToWebsocket() }, 1000);
+      }
+    },
+
     handleNewMessage(event) {
 
       let data = event.data;
@@ -55,6 +110,42 @@ var app = new Vue({
             this.handleRoomJoined(msg);
             break;
 
+          case "message-updated":
+            this.handleMessageUpdated(msg);
+            break;
+
+          case "history-truncated":
+            this.fillHistoryGap(msg.target.id, msg.id);
+            break;
+
+          case "unread":
+            this.handleUnread(msg);
+            break;
+
+          case "message-read":
+            this.handleMessageRead(msg);
+            break;
+
+          case "typing":
+            this.handleTyping(msg);
+            break;
+
+          case "room-left":
+            this.removeRoom(msg.target.id);
+            break;
+
+          case "room-invite":
+            this.handleRoomInvite(msg);
+            break;
+
+          case "session":
+            this.session = msg.message;
+            break;
+
+          case "error":
+            this.handleError(msg);
+            break;
+
           default:
             break;
         }
@@ -63,14 +154,205 @@ var app = new Vue({
     },
 
     handleChatMessage(msg) {
+      const room = this.findRoom(msg.target.id);
+      if (typeof room === "undefined") {
+        return;
+      }
+      // History backfill and live traffic may overlap, a known message may have changed meanwhile
+      if (msg.id && room.messages.some((message) => message.id === msg.id)) {
+        this.handleMessageUpdated(msg);
+        return;
+      }
+      this.insertMessage(room, msg);
+      if (msg.sender) {
+        this.removeTypist(room, msg.sender.id);
+        if (msg.sender.id !== this.user.id) {
+          room.unread++;
+        }
+      }
+      if (msg.id && (!this.lastMessage || new Date(msg.createdAt) > new Date(this.lastMessage.createdAt))) {
+        this.lastMessage = msg;
+      }
+    },
+
+    // Backfilled messages may arrive after newer live traffic, so messages are
+    // inserted in the order of the server, by time and id
+    insertMessage(room, msg) {
+      const createdAt = new Date(msg.createdAt).getTime();
+      let i = room.messages.length;
+      while (i > 0) {
+        const previous = room.messages[i - 1];
+        const previousCreatedAt = new Date(previous.createdAt).getTime();
+        if (previousCreatedAt < createdAt || (previousCreatedAt === createdAt && previous.id < msg.id)) {
+          break;
+        }
+        i--;
+      }
+      room.messages.splice(i, 0, msg);
+    },
+
+    handleMessageUpdated(msg) {
+      const room = this.findRoom(msg.target.id);
+      if (typeof room === "undefined") {
+        return;
+      }
+      const message = room.messages.find((message) => message.id === msg.id);
+      if (typeof message !== "undefined") {
+        message.message = msg.message;
+        Vue.set(message, "editedAt", msg.editedAt);
+        Vue.set(message, "deletedAt", msg.deletedAt);
+      }
+    },
+
+    canChange(message) {
+      return message.id && message.sender && message.sender.id === this.user.id && !message.deletedAt;
+    },
+
+    editMessage(message) {
+      const text = prompt("Edit message", message.message);
+      if (text) {
+        this.send({ action: 'edit-message', id: message.id, message: text });
+      }
+    },
+
+    deleteMessage(message) {
+      this.send({ action: 'delete-message', id: message.id });
+    },
+
+    // Pages back from the message with ID before until reaching messages we already have
+    fillHistoryGap(roomId, before) {
+      fetch("/api/rooms/" + roomId + "/messages?before=" + encodeURIComponent(before), {
+        headers: { "Authorization": "Bearer " + this.user.token }
+      })
+        .then((response) => {
+          if (!response.ok) {
+            return response.text().then((text) => { throw new Error(text); });
+          }
+          return response.json();
+        })
+        .then((messages) => {
+          const room = this.findRoom(roomId);
+          if (typeof room === "undefined" || messages.length === 0) {
+            return;
+          }
+          const missing = messages.filter((msg) => !room.messages.some((message) => message.id === msg.id));
+          missing.forEach((msg) => { msg.target = { id: roomId }; this.insertMessage(room, msg); });
+          if (missing.length === messages.length) {
+            this.fillHistoryGap(roomId, messages[0].id);
+          }
+        })
+        .catch((error) => {
+          this.serverError = error.message;
+        });
+    },
+
+    handleUnread(msg) {
       const room = this.findRoom(msg.target.id);
       if (typeof room !== "undefined") {
-        room.messages.push(msg);
+        room.unread = msg.unread || 0;
+      }
+    },
+
+    handleMessageRead(msg) {
+      const room = this.findRoom(msg.target.id);
+      if (typeof room === "undefined") {
+        return;
+      }
+      // Read on another device
+      if (msg.sender.id === this.user.id) {
+        room.unread = 0;
+        return;
+      }
+      room.receipts = room.receipts.filter((receipt) => receipt.userId !== msg.sender.id);
+      room.receipts.push({ userId: msg.sender.id, name: msg.sender.name, messageId: msg.id });
+    },
+
+    seenBy(room, message) {
+      return room.receipts
+        .filter((receipt) => receipt.messageId === message.id)
+        .map((receipt) => receipt.name);
+    },
+
+    markRead(room) {
+      // Announcements have no sender and are not stored, so they can't be read
+      const stored = room.messages.filter((message) => message.id && message.sender);
+      if (room.unread === 0 || stored.length === 0) {
+        return;
+      }
+      this.send({ action: 'mark-read', id: stored[stored.length - 1].id });
+      room.unread = 0;
+    },
+
+    handleTyping(msg) {
+      const room = this.findRoom(msg.target.id);
+      if (typeof room === "undefined" || msg.sender.id === this.user.id) {
+        return;
+      }
+      this.removeTypist(room, msg.sender.id);
+      if (msg.message === "started") {
+        // The server repeats started while the user types, so a missed stopped can't stick
+        const typist = { id: msg.sender.id, name: msg.sender.name };
+        typist.timer = setTimeout(() => { this.removeTypist(room, typist.id) }, 6000);
+        room.typists.push(typist);
+      }
+    },
+
+    removeTypist(room, userId) {
+      for (let i = 0; i < room.typists.length; i++) {
+        if (room.typists[i].id === userId) {
+          clearTimeout(room.typists[i].timer);
+          room.typists.splice(i, 1);
+          break;
+        }
+      }
+    },
+
+    sendTyping(room) {
+      // The server relays typing at most every few seconds, so there is no use in sending more
+      if (Date.now() - room.typingSentAt < 1000) {
+        return;
+      }
+      room.typingSentAt = Date.now();
+      // No request id, typing is not worth an ack
+      this.ws.send(JSON.stringify({ action: 'typing', target: { id: room.id } }));
+    },
+
+    handleRoomInvite(msg) {
+      if (!this.invitations.some((invitation) => invitation.room.id === msg.target.id)) {
+        this.invitations.push({ room: msg.target, sender: msg.sender });
+      }
+    },
+
+    answerInvitation(invitation, accept) {
+      this.send({ action: accept ? 'accept-invite' : 'decline-invite', message: invitation.room.id });
+      this.invitations.splice(this.invitations.indexOf(invitation), 1);
+    },
+
+    createGroup() {
+      this.send({ action: 'create-group', message: this.groupInput });
+      this.groupInput = "";
+    },
+
+    inviteUser(room) {
+      if (room.invitee) {
+        this.send({ action: 'invite-user', message: room.invitee, target: { id: room.id } });
+        room.invitee = null;
+      }
+    },
+
+    handleError(msg) {
+      this.serverError = msg.code + ": " + msg.message;
+      // Too late to resume, the server starts us without rooms
+      if (msg.code === "session-not-found") {
+        this.rooms = [];
+        this.lastMessage = null;
       }
     },
 
     handleUserJoined(msg) {
-      this.users.push(msg.sender);
+      if (!this.users.some((user) => user.id === msg.sender.id)) {
+        this.users.push(msg.sender);
+      }
     },
 
     handleUserLeft(msg) {
@@ -82,23 +364,34 @@ var app = new Vue({
     },
 
     handleRoomJoined(msg) {
+      // Rooms entered again after reconnecting or from another device are already listed
+      if (typeof this.findRoom(msg.target.id) !== "undefined") {
+        return;
+      }
       room = msg.target;
-      room.name = room.private ? msg.sender.name : room.name;
+      // Direct rooms are named after the other party, groups keep their name
+      room.name = room.private && msg.sender ? msg.sender.name : room.name;
+      room.invitee = null;
       room["messages"] = [];
+      room.typists = [];
+      room.typingSentAt = 0;
+      room.unread = 0;
+      room.receipts = [];
       this.rooms.push(room);
     },
 
     sendMessage(room) {
       if (room.newMessage !== "") {
-        this.ws.send(JSON.stringify({
+        this.send({
           action: 'send-message',
           message: room.newMessage,
           target: {
             id: room.id,
             name: room.name
           }
-        }));
+        });
         room.newMessage = "";
+        this.markRead(room);
       }
     },
 
@@ -111,15 +404,18 @@ var app = new Vue({
     },
 
     joinRoom() {
-      this.ws.send(JSON.stringify({ action: 'join-room', message: this.roomInput }));
+      this.send({ action: 'join-room', message: this.roomInput });
       this.roomInput = "";
     },
 
     leaveRoom(room) {
-      this.ws.send(JSON.stringify({ action: 'leave-room', message: room.id }));
+      this.send({ action: 'leave-room', message: room.id });
+      this.removeRoom(room.id);
+    },
 
+    removeRoom(roomId) {
       for (let i = 0; i < this.rooms.length; i++) {
-        if (this.rooms[i].id === room.id) {
+        if (this.rooms[i].id === roomId) {
           this.rooms.splice(i, 1);
           break;
         }
@@ -127,7 +423,13 @@ var app = new Vue({
     },
 
     joinPrivateRoom(room) {
-      this.ws.send(JSON.stringify({ action: 'join-room-private', message: room.id }));
+      this.send({ action: 'join-room-private', message: room.id });
+    },
+
+    send(payload) {
+      // Errors and acks reference the request they answer
+      payload.requestId = String(++this.requestCounter);
+      this.ws.send(JSON.stringify(payload));
     }
   }
 })
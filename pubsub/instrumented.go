@@ -0,0 +1,32 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	"chat/metrics"
+)
+
+// Instrumented records publish latency and errors of the wrapped pub/sub
+type Instrumented struct {
+	PubSub
+	backend string
+}
+
+// NewInstrumented wraps pubSub, backend labels its metrics
+func NewInstrumented(pubSub PubSub, backend string) *Instrumented {
+	return &Instrumented{PubSub: pubSub, backend: backend}
+}
+
+// Publish publishes through the wrapped pub/sub
+func (pubSub *Instrumented) Publish(ctx context.Context, channel string, message []byte) error {
+
+	start := time.Now()
+	err := pubSub.PubSub.Publish(ctx, channel, message)
+	metrics.PublishDuration.WithLabelValues(pubSub.backend).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.PublishErrors.WithLabelValues(pubSub.backend).Inc()
+	}
+
+	return err
+}
@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+// Size of the per subscription buffer
+const memoryBufferSize = 256
+
+// Memory in-process pub/sub, for running a single node without redis
+type Memory struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[*memorySubscription]bool
+}
+
+// NewMemory creates in-process pub/sub
+func NewMemory() *Memory {
+	return &Memory{
+		subscribers: make(map[string]map[*memorySubscription]bool),
+	}
+}
+
+// Publish delivers message to every current subscriber of the channel
+func (pubSub *Memory) Publish(ctx context.Context, channel string, message []byte) error {
+
+	pubSub.mu.RLock()
+	subscriptions := make([]*memorySubscription, 0, len(pubSub.subscribers[channel]))
+	for subscription := range pubSub.subscribers[channel] {
+		subscriptions = append(subscriptions, subscription)
+	}
+	pubSub.mu.RUnlock()
+
+	for _, subscription := range subscriptions {
+		// Every subscriber gets its own copy, like from a real broker
+		payload := append([]byte(nil), message...)
+		select {
+		case subscription.buffer <- payload:
+		case <-subscription.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Subscribe subscribes to the channel
+func (pubSub *Memory) Subscribe(ctx context.Context, channel string) (Subscription, error) {
+
+	subscription := &memorySubscription{
+		pubSub:   pubSub,
+		channel:  channel,
+		buffer:   make(chan []byte, memoryBufferSize),
+		messages: make(chan []byte),
+		done:     make(chan struct{}),
+	}
+	go subscription.forward()
+
+	pubSub.mu.Lock()
+	defer pubSub.mu.Unlock()
+
+	if _, ok := pubSub.subscribers[channel]; !ok {
+		pubSub.subscribers[channel] = make(map[*memorySubscription]bool)
+	}
+	pubSub.subscribers[channel][subscription] = true
+
+	return subscription, nil
+}
+
+// Ping always succeeds, there is no connection to lose
+func (pubSub *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close unsubscribes all subscribers
+func (pubSub *Memory) Close() error {
+
+	pubSub.mu.Lock()
+	var subscriptions []*memorySubscription
+	for _, channelSubscribers := range pubSub.subscribers {
+		for subscription := range channelSubscribers {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	pubSub.mu.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.Unsubscribe()
+	}
+
+	return nil
+}
+
+func (pubSub *Memory) remove(subscription *memorySubscription) {
+
+	pubSub.mu.Lock()
+	defer pubSub.mu.Unlock()
+
+	delete(pubSub.subscribers[subscription.channel], subscription)
+	if len(pubSub.subscribers[subscription.channel]) == 0 {
+		delete(pubSub.subscribers, subscription.channel)
+	}
+}
+
+type memorySubscription struct {
+	pubSub   *Memory
+	channel  string
+	buffer   chan []byte
+	messages chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Publishers write to the buffer only, so the messages channel
+// can be safely closed here once unsubscribed.
+func (subscription *memorySubscription) forward() {
+
+	defer close(subscription.messages)
+	for {
+		select {
+		case message := <-subscription.buffer:
+			select {
+			case subscription.messages <- message:
+			case <-subscription.done:
+				return
+			}
+		case <-subscription.done:
+			return
+		}
+	}
+}
+
+func (subscription *memorySubscription) Channel() <-chan []byte {
+	return subscription.messages
+}
+
+func (subscription *memorySubscription) Unsubscribe() error {
+
+	subscription.once.Do(func() {
+		subscription.pubSub.remove(subscription)
+		close(subscription.done)
+	})
+
+	return nil
+}
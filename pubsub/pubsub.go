@@ -0,0 +1,19 @@
+package pubsub
+
+import "context"
+
+// PubSub publishes messages to named channels and delivers them to subscribers
+type PubSub interface {
+	Publish(ctx context.Context, channel string, message []byte) error
+	Subscribe(ctx context.Context, channel string) (Subscription, error)
+	// Ping checks that the backend is reachable
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// Subscription receives messages published to a channel
+type Subscription interface {
+	// Channel is closed after Unsubscribe
+	Channel() <-chan []byte
+	Unsubscribe() error
+}
@@ -0,0 +1,88 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis pub/sub backed by a redis server, shared by all chat nodes
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis creates redis backed pub/sub
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{client: client}
+}
+
+// Publish publishes message to the channel
+func (pubSub *Redis) Publish(ctx context.Context, channel string, message []byte) error {
+	return pubSub.client.Publish(ctx, channel, message).Err()
+}
+
+// Subscribe subscribes to the channel
+func (pubSub *Redis) Subscribe(ctx context.Context, channel string) (Subscription, error) {
+
+	redisPubSub := pubSub.client.Subscribe(ctx, channel)
+
+	// Wait for confirmation so messages published right after are not lost
+	if _, err := redisPubSub.Receive(ctx); err != nil {
+		redisPubSub.Close()
+		return nil, err
+	}
+
+	subscription := &redisSubscription{
+		pubSub:   redisPubSub,
+		messages: make(chan []byte),
+		done:     make(chan struct{}),
+	}
+	go subscription.forward()
+
+	return subscription, nil
+}
+
+// Ping sends PING to redis
+func (pubSub *Redis) Ping(ctx context.Context) error {
+	return pubSub.client.Ping(ctx).Err()
+}
+
+// Close closes the redis client
+func (pubSub *Redis) Close() error {
+	return pubSub.client.Close()
+}
+
+type redisSubscription struct {
+	pubSub   *redis.PubSub
+	messages chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (subscription *redisSubscription) forward() {
+
+	defer close(subscription.messages)
+	for msg := range subscription.pubSub.Channel() {
+		select {
+		case subscription.messages <- []byte(msg.Payload):
+		case <-subscription.done:
+			return
+		}
+	}
+}
+
+func (subscription *redisSubscription) Channel() <-chan []byte {
+	return subscription.messages
+}
+
+func (subscription *redisSubscription) Unsubscribe() error {
+
+	var err error
+	subscription.once.Do(func() {
+		close(subscription.done)
+		err = subscription.pubSub.Close()
+	})
+
+	return err
+}
@@ -0,0 +1,39 @@
+package main
+
+import "time"
+
+// tokenBucket allows bursts up to its capacity and refills at a steady rate.
+// It is only used from a single goroutine, so there is no locking.
+type tokenBucket struct {
+	capacity   float64
+	rate       float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newTokenBucket(capacity int, perSecond float64) *tokenBucket {
+	return &tokenBucket{
+		capacity:   float64(capacity),
+		rate:       perSecond,
+		tokens:     float64(capacity),
+		lastRefill: time.Now(),
+	}
+}
+
+// allow takes a token if there is one available
+func (bucket *tokenBucket) allow() bool {
+
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.lastRefill).Seconds() * bucket.rate
+	if bucket.tokens > bucket.capacity {
+		bucket.tokens = bucket.capacity
+	}
+	bucket.lastRefill = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
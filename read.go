@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+)
+
+// Moves the read cursor of the client to the message with the ID of the message,
+// members of private rooms are told the client read up to it
+func (client *Client) handleMarkReadMessage(message Message) {
+
+	read, err := client.wsServer.messageRepository.FindMessageByID(ctx, message.ID)
+	if err != nil {
+		log.Printf("Error on finding message %s: %s", message.ID, err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not mark message read")
+		return
+	}
+
+	if read == nil {
+		client.sendError(message.RequestID, ErrorCodeNoMessage, "message not found")
+		return
+	}
+
+	room, err := client.wsServer.findRoomByID(read.GetTarget().GetID())
+	if err != nil {
+		log.Printf("Error on finding room %s: %s", read.GetTarget().GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not mark message read")
+		return
+	}
+
+	if room == nil {
+		client.sendError(message.RequestID, ErrorCodeRoomNotFound, "room not found")
+		return
+	}
+
+	member, err := client.isRoomMember(room)
+	if err != nil {
+		log.Printf("Error on checking membership of room %s: %s", room.GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not mark message read")
+		return
+	}
+
+	// Don't tell whether messages of other rooms exist
+	if !member {
+		client.sendError(message.RequestID, ErrorCodeNoMessage, "message not found")
+		return
+	}
+
+	moved, err := client.wsServer.messageRepository.MarkRead(ctx, room.GetID(), client.GetID(), read)
+	if err != nil {
+		log.Printf("Error on marking message %s read: %s", read.GetID(), err)
+		client.sendError(message.RequestID, ErrorCodeInternal, "could not mark message read")
+		return
+	}
+
+	// Receipts go through the room channel, so members on every node see them
+	if moved && room.Private {
+		receipt := &Message{
+			ID:     read.GetID(),
+			Action: MessageReadAction,
+			Target: room,
+			Sender: client,
+		}
+		room.publishRoomMessage(receipt)
+	}
+
+	client.sendAck(message.RequestID)
+}
+
+// Tells the client how many unread messages each of the rooms has,
+// sent after the history of a room to correct what the client counted
+func (client *Client) sendUnreadCounts(rooms []*Room) {
+
+	counts, err := client.wsServer.messageRepository.GetUnreadCounts(ctx, client.GetID())
+	if err != nil {
+		log.Printf("Error on counting unread messages of %s: %s", client.GetID(), err)
+		client.sendError("", ErrorCodeInternal, "could not count unread messages")
+		return
+	}
+
+	// Rooms without unread messages are sent too, a resumed client may still count some
+	for _, room := range rooms {
+		message := &Message{
+			Action: UnreadAction,
+			Target: room,
+			Unread: counts[room.GetID()],
+		}
+		client.sendMessage(message)
+	}
+}
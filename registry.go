@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sync"
+
+	"chat/models"
+)
+
+// registry indexes the clients, rooms and online users known to this node.
+// It is shared by the server loop, the pub/sub listener and the client
+// goroutines, so every access goes through its lock.
+type registry struct {
+	mu          sync.RWMutex
+	clients     map[*Client]bool
+	clientsByID map[string]map[*Client]bool
+	roomsByID   map[string]*Room
+	roomsByName map[string]*Room
+	users       map[string]models.User
+}
+
+func newRegistry() *registry {
+	return &registry{
+		clients:     make(map[*Client]bool),
+		clientsByID: make(map[string]map[*Client]bool),
+		roomsByID:   make(map[string]*Room),
+		roomsByName: make(map[string]*Room),
+		users:       make(map[string]models.User),
+	}
+}
+
+// addClient indexes the client along with the other connections of its user
+func (r *registry) addClient(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clients[client] = true
+	if r.clientsByID[client.GetID()] == nil {
+		r.clientsByID[client.GetID()] = make(map[*Client]bool)
+	}
+	r.clientsByID[client.GetID()][client] = true
+}
+
+// removeClient returns false if the client was not registered
+func (r *registry) removeClient(client *Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[client]; !ok {
+		return false
+	}
+
+	delete(r.clients, client)
+	delete(r.clientsByID[client.GetID()], client)
+	if len(r.clientsByID[client.GetID()]) == 0 {
+		delete(r.clientsByID, client.GetID())
+	}
+	return true
+}
+
+// findClientsByID returns the connections of the user on this node
+func (r *registry) findClientsByID(ID string) []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(r.clientsByID[ID]))
+	for client := range r.clientsByID[ID] {
+		clients = append(clients, client)
+	}
+
+	return clients
+}
+
+// clientList returns a snapshot, so callers may block on clients without holding the lock
+func (r *registry) clientList() []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(r.clients))
+	for client := range r.clients {
+		clients = append(clients, client)
+	}
+
+	return clients
+}
+
+// addRoom indexes the room unless a running room with the same id is
+// already loaded, that room is returned instead and added is false
+func (r *registry) addRoom(room *Room) (loaded *Room, added bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.roomsByID[room.GetID()]; ok && !existing.Stopped() {
+		return existing, false
+	}
+
+	r.roomsByID[room.GetID()] = room
+	r.roomsByName[room.GetName()] = room
+	return room, true
+}
+
+// removeRoom returns false if the room was already replaced or removed
+func (r *registry) removeRoom(room *Room) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.roomsByID[room.GetID()] != room {
+		return false
+	}
+
+	delete(r.roomsByID, room.GetID())
+	if r.roomsByName[room.GetName()] == room {
+		delete(r.roomsByName, room.GetName())
+	}
+	return true
+}
+
+// findRoomByID skips stopped rooms, they are about to be removed
+func (r *registry) findRoomByID(ID string) *Room {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if room, ok := r.roomsByID[ID]; ok && !room.Stopped() {
+		return room
+	}
+
+	return nil
+}
+
+// findRoomByName skips stopped rooms, they are about to be removed
+func (r *registry) findRoomByName(name string) *Room {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if room, ok := r.roomsByName[name]; ok && !room.Stopped() {
+		return room
+	}
+
+	return nil
+}
+
+func (r *registry) roomList() []*Room {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rooms := make([]*Room, 0, len(r.roomsByID))
+	for _, room := range r.roomsByID {
+		rooms = append(rooms, room)
+	}
+
+	return rooms
+}
+
+func (r *registry) roomCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.roomsByID)
+}
+
+// addUser returns false if the user was already online
+func (r *registry) addUser(user models.User) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[user.GetID()]; ok {
+		return false
+	}
+
+	r.users[user.GetID()] = user
+	return true
+}
+
+func (r *registry) removeUser(ID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.users, ID)
+}
+
+func (r *registry) findUserByID(ID string) models.User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.users[ID]
+}
+
+func (r *registry) userList() []models.User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := make([]models.User, 0, len(r.users))
+	for _, user := range r.users {
+		users = append(users, user)
+	}
+
+	return users
+}
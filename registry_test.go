@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"chat/pubsub"
+
+	"github.com/google/uuid"
+)
+
+func newTestRoom(name string) *Room {
+	return NewRoom(name, false, pubsub.NewMemory())
+}
+
+func newTestClient(server *WsServer, userID uuid.UUID) *Client {
+	return &Client{
+		ID:           userID,
+		connectionID: uuid.New().String(),
+		Name:         userID.String(),
+		wsServer:     server,
+		send:         make(chan []byte, 1024),
+		done:         make(chan struct{}),
+		rooms:        make(map[*Room]bool),
+		limiter:      newTokenBucket(100, 100),
+	}
+}
+
+func TestRegistryClients(t *testing.T) {
+
+	registry := newRegistry()
+	userID := uuid.New()
+	first := newTestClient(nil, userID)
+	second := newTestClient(nil, userID)
+
+	registry.addClient(first)
+	registry.addClient(second)
+	if got := len(registry.findClientsByID(userID.String())); got != 2 {
+		t.Fatalf("findClientsByID returned %d clients, want 2", got)
+	}
+
+	if !registry.removeClient(first) {
+		t.Fatal("removeClient returned false for a registered client")
+	}
+	if registry.removeClient(first) {
+		t.Fatal("removeClient returned true for a removed client")
+	}
+	if clients := registry.findClientsByID(userID.String()); len(clients) != 1 || clients[0] != second {
+		t.Fatalf("findClientsByID returned %v, want the second client only", clients)
+	}
+
+	registry.removeClient(second)
+	if got := len(registry.clientsByID); got != 0 {
+		t.Fatalf("clientsByID has %d users left, want 0", got)
+	}
+}
+
+func TestRegistryRooms(t *testing.T) {
+
+	registry := newRegistry()
+	room := newTestRoom("general")
+
+	if loaded, added := registry.addRoom(room); !added || loaded != room {
+		t.Fatal("addRoom did not add a new room")
+	}
+
+	duplicate := newTestRoom("general")
+	duplicate.ID = room.ID
+	if loaded, added := registry.addRoom(duplicate); added || loaded != room {
+		t.Fatal("addRoom replaced a running room")
+	}
+
+	// A stopped room is about to be removed, so it is skipped and may be replaced
+	room.Stop()
+	if registry.findRoomByName("general") != nil || registry.findRoomByID(room.GetID()) != nil {
+		t.Fatal("found a stopped room")
+	}
+	if loaded, added := registry.addRoom(duplicate); !added || loaded != duplicate {
+		t.Fatal("addRoom did not replace a stopped room")
+	}
+
+	if registry.removeRoom(room) {
+		t.Fatal("removeRoom removed a replaced room")
+	}
+	if registry.findRoomByName("general") != duplicate {
+		t.Fatal("removing the replaced room removed its replacement")
+	}
+	if !registry.removeRoom(duplicate) {
+		t.Fatal("removeRoom returned false for a loaded room")
+	}
+	if registry.roomCount() != 0 {
+		t.Fatalf("roomCount is %d, want 0", registry.roomCount())
+	}
+}
+
+// Run with -race, the server loop, the pub/sub listener and the client
+// goroutines all share the registry
+func TestRegistryConcurrentAccess(t *testing.T) {
+
+	registry := newRegistry()
+	users := make([]uuid.UUID, 10)
+	for i := range users {
+		users[i] = uuid.New()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			client := newTestClient(nil, users[i%len(users)])
+			room := newTestRoom(fmt.Sprintf("room-%d", i%5))
+
+			for j := 0; j < 100; j++ {
+				registry.addClient(client)
+				registry.findClientsByID(client.GetID())
+				registry.addRoom(room)
+				registry.findRoomByName(room.GetName())
+				registry.findRoomByID(room.GetID())
+				registry.clientList()
+				registry.roomList()
+				registry.removeRoom(room)
+				registry.removeClient(client)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := len(registry.clientList()); got != 0 {
+		t.Fatalf("%d clients left, want 0", got)
+	}
+	if got := len(registry.clientsByID); got != 0 {
+		t.Fatalf("%d users left in clientsByID, want 0", got)
+	}
+	if got := registry.roomCount(); got != 0 {
+		t.Fatalf("%d rooms left, want 0", got)
+	}
+}
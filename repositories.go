@@ -0,0 +1,27 @@
+package main
+
+import (
+	"database/sql"
+
+	"chat/models"
+	"chat/repository"
+)
+
+// The repositories of one database, shared by the websocket server and the API
+type repositories struct {
+	rooms    models.RoomRepository
+	messages models.MessageRepository
+	accounts models.AccountRepository
+}
+
+// The driver was validated with the config, sqlite3 or postgres
+func newRepositories(driver string, db *sql.DB) *repositories {
+
+	repoDB := repository.NewDB(db, driver)
+
+	return &repositories{
+		rooms:    &repository.RoomRepository{Db: repoDB},
+		messages: &repository.MessageRepository{Db: repoDB},
+		accounts: &repository.AccountRepository{Db: repoDB},
+	}
+}
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"chat/metrics"
+	"chat/models"
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Account ...
+type Account struct {
+	ID       string
+	Name     string
+	Username string
+	Password string
+}
+
+// GetID returns id property
+func (account *Account) GetID() string {
+	return account.ID
+}
+
+// GetName returns name property
+func (account *Account) GetName() string {
+	return account.Name
+}
+
+// GetUsername returns username property
+func (account *Account) GetUsername() string {
+	return account.Username
+}
+
+// GetPassword returns password hash
+func (account *Account) GetPassword() string {
+	return account.Password
+}
+
+// AccountRepository for db interaction
+type AccountRepository struct {
+	Db *DB
+}
+
+// AddAccount adds account into database
+func (repo *AccountRepository) AddAccount(ctx context.Context, account models.Account) error {
+
+	defer metrics.ObserveQuery("AddAccount", time.Now())
+
+	stmt, err := repo.Db.PrepareContext(
+		ctx,
+		`INSERT INTO account(id, name, username, password)
+		 VALUES (?, ?, ?, ?)`,
+	)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, account.GetID(), account.GetName(), account.GetUsername(), account.GetPassword())
+
+	return err
+}
+
+// FindAccountByUsername finds account by username in database, returns nil if there is no such account
+func (repo *AccountRepository) FindAccountByUsername(ctx context.Context, username string) (models.Account, error) {
+
+	defer metrics.ObserveQuery("FindAccountByUsername", time.Now())
+
+	row := repo.Db.QueryRowContext(
+		ctx,
+		`SELECT id,
+				name,
+				username,
+				password
+		 FROM account
+		 WHERE username = ?
+		 LIMIT 1`,
+		username,
+	)
+
+	var account Account
+	if err := row.Scan(&account.ID, &account.Name, &account.Username, &account.Password); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// FindAccountByID finds account by id in database, returns nil if there is no such account
+func (repo *AccountRepository) FindAccountByID(ctx context.Context, id string) (models.Account, error) {
+
+	defer metrics.ObserveQuery("FindAccountByID", time.Now())
+
+	row := repo.Db.QueryRowContext(
+		ctx,
+		`SELECT id,
+				name,
+				username,
+				password
+		 FROM account
+		 WHERE id = ?`,
+		id,
+	)
+
+	var account Account
+	if err := row.Scan(&account.ID, &account.Name, &account.Username, &account.Password); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &account, nil
+}
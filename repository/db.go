@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// DB runs the queries of the repositories on sqlite3 or postgres. Queries are
+// written once with ? placeholders and in SQL both databases understand.
+type DB struct {
+	*sql.DB
+	driver string
+}
+
+// NewDB wraps db opened with driver, sqlite3 or postgres
+func NewDB(db *sql.DB, driver string) *DB {
+	return &DB{DB: db, driver: driver}
+}
+
+// PrepareContext prepares the query rebound for the driver
+func (db *DB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return db.DB.PrepareContext(ctx, Rebind(db.driver, query))
+}
+
+// QueryContext runs the query rebound for the driver
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, Rebind(db.driver, query), args...)
+}
+
+// QueryRowContext runs the query rebound for the driver
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRowContext(ctx, Rebind(db.driver, query), args...)
+}
+
+// ExecContext runs the query rebound for the driver
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, Rebind(db.driver, query), args...)
+}
+
+// Rebind numbers the ? placeholders of query for postgres, other drivers take them as they are
+func Rebind(driver string, query string) string {
+
+	if driver != "postgres" {
+		return query
+	}
+
+	var rebound strings.Builder
+	n := 0
+	for _, char := range query {
+		if char == '?' {
+			n++
+			rebound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		rebound.WriteRune(char)
+	}
+
+	return rebound.String()
+}
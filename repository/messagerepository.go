@@ -0,0 +1,370 @@
+package repository
+
+import (
+	"chat/metrics"
+	"chat/models"
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Message ...
+type Message struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Message   string    `json:"message"`
+	Target    *Room     `json:"target"`
+	Sender    *User     `json:"sender"`
+	// Set once the message was edited or deleted, deleted messages lose their text
+	EditedAt  *time.Time `json:"editedAt,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// GetID returns id property
+func (message *Message) GetID() string {
+	return message.ID
+}
+
+// GetCreatedAt returns created at property
+func (message *Message) GetCreatedAt() time.Time {
+	return message.CreatedAt
+}
+
+// GetMessage returns message text
+func (message *Message) GetMessage() string {
+	return message.Message
+}
+
+// GetTarget returns room the message was sent to
+func (message *Message) GetTarget() models.Room {
+	return message.Target
+}
+
+// GetSender returns user who sent the message
+func (message *Message) GetSender() models.User {
+	return message.Sender
+}
+
+// GetEditedAt returns when the message was last edited, nil if never
+func (message *Message) GetEditedAt() *time.Time {
+	return message.EditedAt
+}
+
+// GetDeletedAt returns when the message was deleted, nil if it wasn't
+func (message *Message) GetDeletedAt() *time.Time {
+	return message.DeletedAt
+}
+
+// MessageRepository for db interaction
+type MessageRepository struct {
+	Db *DB
+}
+
+// AddMessage adds message into database
+func (repo *MessageRepository) AddMessage(ctx context.Context, message models.Message) error {
+
+	defer metrics.ObserveQuery("AddMessage", time.Now())
+
+	stmt, err := repo.Db.PrepareContext(
+		ctx,
+		`INSERT INTO message(id, room_id, sender_id, sender_name, message, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+	)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	sender := message.GetSender()
+	_, err = stmt.ExecContext(
+		ctx,
+		message.GetID(),
+		message.GetTarget().GetID(),
+		sender.GetID(),
+		sender.GetName(),
+		message.GetMessage(),
+		message.GetCreatedAt(),
+	)
+
+	return err
+}
+
+// GetRoomMessages gets last messages of the room from database in chronological order
+// Passing a message id in before pages back to messages older than that message,
+// messages stored at the same time are ordered by id so none is skipped
+func (repo *MessageRepository) GetRoomMessages(ctx context.Context, roomID string, before string, limit int) ([]models.Message, error) {
+
+	defer metrics.ObserveQuery("GetRoomMessages", time.Now())
+
+	rows, err := repo.Db.QueryContext(
+		ctx,
+		`SELECT m.id,
+				m.created_at,
+				m.sender_id,
+				m.sender_name,
+				m.message,
+				m.edited_at,
+				m.deleted_at
+		 FROM message m
+		 LEFT JOIN message c ON c.id = ?
+		 WHERE m.room_id = ?
+		   AND (? = '' OR m.created_at < c.created_at OR (m.created_at = c.created_at AND m.id < c.id))
+		 ORDER BY m.created_at DESC, m.id DESC
+		 LIMIT ?`,
+		before,
+		roomID,
+		before,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]models.Message, 0)
+	defer rows.Close()
+
+	for rows.Next() {
+		message := Message{
+			Target: &Room{ID: roomID},
+			Sender: &User{},
+		}
+		err = rows.Scan(
+			&message.ID,
+			&message.CreatedAt,
+			&message.Sender.ID,
+			&message.Sender.Name,
+			&message.Message,
+			&message.EditedAt,
+			&message.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		// prepend, rows come newest first
+		messages = append([]models.Message{&message}, messages...)
+	}
+
+	return messages, rows.Err()
+}
+
+// FindMessageByID finds a stored message, returns nil if there is none
+func (repo *MessageRepository) FindMessageByID(ctx context.Context, id string) (models.Message, error) {
+
+	defer metrics.ObserveQuery("FindMessageByID", time.Now())
+
+	row := repo.Db.QueryRowContext(
+		ctx,
+		`SELECT id,
+				room_id,
+				created_at,
+				sender_id,
+				sender_name,
+				message,
+				edited_at,
+				deleted_at
+		 FROM message
+		 WHERE id = ?`,
+		id,
+	)
+
+	message := Message{
+		Target: &Room{},
+		Sender: &User{},
+	}
+	err := row.Scan(
+		&message.ID,
+		&message.Target.ID,
+		&message.CreatedAt,
+		&message.Sender.ID,
+		&message.Sender.Name,
+		&message.Message,
+		&message.EditedAt,
+		&message.DeletedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// GetRoomMessagesSince gets last messages of the room stored, edited or deleted at or after since in chronological order.
+// Messages at since are included, others may share the time of the last message a client got.
+func (repo *MessageRepository) GetRoomMessagesSince(ctx context.Context, roomID string, since time.Time, limit int) ([]models.Message, error) {
+
+	defer metrics.ObserveQuery("GetRoomMessagesSince", time.Now())
+
+	rows, err := repo.Db.QueryContext(
+		ctx,
+		`SELECT m.id,
+				m.created_at,
+				m.sender_id,
+				m.sender_name,
+				m.message,
+				m.edited_at,
+				m.deleted_at
+		 FROM message m
+		 WHERE m.room_id = ?
+		   AND (m.created_at >= ? OR m.edited_at >= ? OR m.deleted_at >= ?)
+		 ORDER BY m.created_at DESC, m.id DESC
+		 LIMIT ?`,
+		roomID,
+		since.UTC(),
+		since.UTC(),
+		since.UTC(),
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]models.Message, 0)
+	defer rows.Close()
+
+	for rows.Next() {
+		message := Message{
+			Target: &Room{ID: roomID},
+			Sender: &User{},
+		}
+		err = rows.Scan(
+			&message.ID,
+			&message.CreatedAt,
+			&message.Sender.ID,
+			&message.Sender.Name,
+			&message.Message,
+			&message.EditedAt,
+			&message.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		// prepend, rows come newest first
+		messages = append([]models.Message{&message}, messages...)
+	}
+
+	return messages, rows.Err()
+}
+
+// MarkRead moves the read cursor of the user in the room to the message, a cursor
+// already past the message stays where it is. Returns false if it didn't move.
+func (repo *MessageRepository) MarkRead(ctx context.Context, roomID string, userID string, message models.Message) (bool, error) {
+
+	defer metrics.ObserveQuery("MarkRead", time.Now())
+
+	stmt, err := repo.Db.PrepareContext(
+		ctx,
+		`INSERT INTO room_read(room_id, user_id, message_id, message_created_at)
+		 VALUES (?, ?, ?, ?)
+		 ON CONFLICT (room_id, user_id) DO UPDATE
+		 SET message_id = excluded.message_id,
+			 message_created_at = excluded.message_created_at
+		 WHERE excluded.message_created_at > room_read.message_created_at`,
+	)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, roomID, userID, message.GetID(), message.GetCreatedAt().UTC())
+	if err != nil {
+		return false, err
+	}
+
+	moved, err := result.RowsAffected()
+
+	return moved > 0, err
+}
+
+// GetUnreadCounts counts messages of other users after the read cursor of the user
+// in each room the user is a member of, rooms without unread messages are left out
+func (repo *MessageRepository) GetUnreadCounts(ctx context.Context, userID string) (map[string]int, error) {
+
+	defer metrics.ObserveQuery("GetUnreadCounts", time.Now())
+
+	rows, err := repo.Db.QueryContext(
+		ctx,
+		`SELECT m.room_id,
+				COUNT(*)
+		 FROM room_member rm
+		 JOIN message m ON m.room_id = rm.room_id AND m.sender_id <> rm.user_id AND m.deleted_at IS NULL
+		 LEFT JOIN room_read r ON r.room_id = rm.room_id AND r.user_id = rm.user_id
+		 WHERE rm.user_id = ?
+		   AND (r.message_created_at IS NULL OR m.created_at > r.message_created_at)
+		 GROUP BY m.room_id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	defer rows.Close()
+
+	for rows.Next() {
+		var roomID string
+		var count int
+		if err = rows.Scan(&roomID, &count); err != nil {
+			return nil, err
+		}
+		counts[roomID] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// EditMessage replaces the text of a message which was not deleted,
+// returns false if there is no such message
+func (repo *MessageRepository) EditMessage(ctx context.Context, id string, text string, editedAt time.Time) (bool, error) {
+
+	defer metrics.ObserveQuery("EditMessage", time.Now())
+
+	stmt, err := repo.Db.PrepareContext(
+		ctx,
+		`UPDATE message
+		 SET message = ?, edited_at = ?
+		 WHERE id = ? AND deleted_at IS NULL`,
+	)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, text, editedAt.UTC(), id)
+	if err != nil {
+		return false, err
+	}
+
+	edited, err := result.RowsAffected()
+
+	return edited > 0, err
+}
+
+// DeleteMessage marks a message deleted and drops its text, the message stays
+// in the history as a placeholder. Returns false if there is no such message.
+func (repo *MessageRepository) DeleteMessage(ctx context.Context, id string, deletedAt time.Time) (bool, error) {
+
+	defer metrics.ObserveQuery("DeleteMessage", time.Now())
+
+	stmt, err := repo.Db.PrepareContext(
+		ctx,
+		`UPDATE message
+		 SET message = '', deleted_at = ?
+		 WHERE id = ? AND deleted_at IS NULL`,
+	)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, deletedAt.UTC(), id)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+
+	return deleted > 0, err
+}
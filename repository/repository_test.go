@@ -0,0 +1,507 @@
+package repository_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"chat/migrations"
+	"chat/models"
+	"chat/repository"
+
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLite(t *testing.T) {
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection would open a database of its own
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	testRepositories(t, db, "sqlite3")
+}
+
+// Runs when CHAT_TEST_POSTGRES_DSN points to a database the tests may write to,
+// they add rows with fresh ids and names, so the database may be reused
+func TestPostgres(t *testing.T) {
+
+	dsn := os.Getenv("CHAT_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CHAT_TEST_POSTGRES_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	testRepositories(t, db, "postgres")
+}
+
+// testRepositories checks the contract of the models repositories, every driver has to pass it
+func testRepositories(t *testing.T, db *sql.DB, driver string) {
+
+	migrator, err := migrations.NewMigrator(db, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	repoDB := repository.NewDB(db, driver)
+	rooms := &repository.RoomRepository{Db: repoDB}
+	messages := &repository.MessageRepository{Db: repoDB}
+	accounts := &repository.AccountRepository{Db: repoDB}
+
+	t.Run("accounts", func(t *testing.T) { testAccountRepository(t, accounts) })
+	t.Run("rooms", func(t *testing.T) { testRoomRepository(t, rooms, accounts) })
+	t.Run("messages", func(t *testing.T) { testMessageRepository(t, messages, rooms) })
+	t.Run("messages at the same time", func(t *testing.T) { testMessagesAtTheSameTime(t, messages, rooms) })
+}
+
+func newAccount(t *testing.T, accounts models.AccountRepository) models.Account {
+
+	id := uuid.New().String()
+	account := &repository.Account{ID: id, Name: "name-" + id, Username: "user-" + id, Password: "hash"}
+	if err := accounts.AddAccount(context.Background(), account); err != nil {
+		t.Fatal(err)
+	}
+
+	return account
+}
+
+func newRoom(t *testing.T, rooms models.RoomRepository, private bool) models.Room {
+
+	id := uuid.New().String()
+	room := &repository.Room{ID: id, Name: "room-" + id, Private: private}
+	if err := rooms.AddRoom(context.Background(), room); err != nil {
+		t.Fatal(err)
+	}
+
+	return room
+}
+
+func newMessage(t *testing.T, messages models.MessageRepository, room models.Room, sender models.User, createdAt time.Time) models.Message {
+
+	message := &repository.Message{
+		ID:        uuid.New().String(),
+		CreatedAt: createdAt,
+		Message:   "text",
+		Target:    &repository.Room{ID: room.GetID()},
+		Sender:    &repository.User{ID: sender.GetID(), Name: sender.GetName()},
+	}
+	if err := messages.AddMessage(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	return message
+}
+
+func messageIDs(messages []models.Message) []string {
+
+	ids := make([]string, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.GetID())
+	}
+
+	return ids
+}
+
+func sameIDs(t *testing.T, what string, got []string, want []string) {
+
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %v, want %v", what, got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%s: got %v, want %v", what, got, want)
+		}
+	}
+}
+
+func testAccountRepository(t *testing.T, accounts models.AccountRepository) {
+
+	ctx := context.Background()
+	account := newAccount(t, accounts)
+
+	found, err := accounts.FindAccountByUsername(ctx, account.GetUsername())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.GetID() != account.GetID() || found.GetPassword() != account.GetPassword() {
+		t.Fatalf("FindAccountByUsername returned %v, want %v", found, account)
+	}
+
+	found, err = accounts.FindAccountByID(ctx, account.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.GetUsername() != account.GetUsername() {
+		t.Fatalf("FindAccountByID returned %v, want %v", found, account)
+	}
+
+	missing, err := accounts.FindAccountByUsername(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing != nil {
+		t.Fatalf("FindAccountByUsername returned %v for an unknown username", missing)
+	}
+
+	missing, err = accounts.FindAccountByID(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing != nil {
+		t.Fatalf("FindAccountByID returned %v for an unknown id", missing)
+	}
+
+	if err := accounts.AddAccount(ctx, &repository.Account{ID: uuid.New().String(), Username: account.GetUsername()}); err == nil {
+		t.Fatal("AddAccount accepted a taken username")
+	}
+}
+
+func testRoomRepository(t *testing.T, rooms models.RoomRepository, accounts models.AccountRepository) {
+
+	ctx := context.Background()
+	public := newRoom(t, rooms, false)
+	private := newRoom(t, rooms, true)
+	owner := newAccount(t, accounts)
+	member := newAccount(t, accounts)
+
+	found, err := rooms.FindRoomByName(ctx, public.GetName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.GetID() != public.GetID() || found.GetPrivate() {
+		t.Fatalf("FindRoomByName returned %v, want %v", found, public)
+	}
+
+	found, err = rooms.FindRoomByID(ctx, private.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.GetName() != private.GetName() || !found.GetPrivate() {
+		t.Fatalf("FindRoomByID returned %v, want %v", found, private)
+	}
+
+	found, err = rooms.FindRoomByID(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != nil {
+		t.Fatalf("FindRoomByID returned %v for an unknown id", found)
+	}
+
+	publicRooms, err := rooms.GetPublicRooms(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed bool
+	for _, room := range publicRooms {
+		if room.GetID() == private.GetID() {
+			t.Fatal("GetPublicRooms listed a private room")
+		}
+		listed = listed || room.GetID() == public.GetID()
+	}
+	if !listed {
+		t.Fatal("GetPublicRooms left out a public room")
+	}
+
+	// Adding a member twice keeps the first role
+	for _, role := range []string{models.RoleOwner, models.RoleMember} {
+		if err := rooms.AddRoomMember(ctx, private.GetID(), owner.GetID(), role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rooms.AddRoomMember(ctx, private.GetID(), member.GetID(), models.RoleMember); err != nil {
+		t.Fatal(err)
+	}
+
+	role, err := rooms.GetRoomMemberRole(ctx, private.GetID(), owner.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != models.RoleOwner {
+		t.Fatalf("GetRoomMemberRole returned %q, want %q", role, models.RoleOwner)
+	}
+
+	// Setting the role a member already has counts as a change too
+	for _, role := range []string{models.RoleModerator, models.RoleModerator} {
+		changed, err := rooms.SetRoomMemberRole(ctx, private.GetID(), member.GetID(), role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !changed {
+			t.Fatal("SetRoomMemberRole returned false for a member")
+		}
+	}
+	role, err = rooms.GetRoomMemberRole(ctx, private.GetID(), member.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != models.RoleModerator {
+		t.Fatalf("GetRoomMemberRole returned %q, want %q", role, models.RoleModerator)
+	}
+	changed, err := rooms.SetRoomMemberRole(ctx, public.GetID(), member.GetID(), models.RoleModerator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatal("SetRoomMemberRole returned true for a user who is not a member")
+	}
+
+	members, err := rooms.GetRoomMembers(ctx, private.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("GetRoomMembers returned %d members, want 2", len(members))
+	}
+
+	userRooms, err := rooms.GetUserRooms(ctx, member.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userRooms) != 1 || userRooms[0].GetID() != private.GetID() {
+		t.Fatalf("GetUserRooms returned %v, want the private room", userRooms)
+	}
+
+	if err := rooms.RemoveRoomMember(ctx, private.GetID(), member.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	isMember, err := rooms.IsRoomMember(ctx, private.GetID(), member.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isMember {
+		t.Fatal("IsRoomMember returned true for a removed member")
+	}
+	role, err = rooms.GetRoomMemberRole(ctx, private.GetID(), member.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != "" {
+		t.Fatalf("GetRoomMemberRole returned %q for a removed member", role)
+	}
+
+	// Inviting twice keeps one invitation
+	for i := 0; i < 2; i++ {
+		if err := rooms.AddRoomInvitation(ctx, private.GetID(), member.GetID(), owner.GetID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invitations, err := rooms.GetUserInvitations(ctx, member.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invitations) != 1 ||
+		invitations[0].GetRoom().GetID() != private.GetID() ||
+		!invitations[0].GetRoom().GetPrivate() ||
+		invitations[0].GetInvitedBy().GetID() != owner.GetID() {
+		t.Fatalf("GetUserInvitations returned %v, want the invitation to the private room", invitations)
+	}
+
+	for _, want := range []bool{true, false} {
+		removed, err := rooms.RemoveRoomInvitation(ctx, private.GetID(), member.GetID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != want {
+			t.Fatalf("RemoveRoomInvitation returned %t, want %t", removed, want)
+		}
+	}
+}
+
+func testMessageRepository(t *testing.T, messages models.MessageRepository, rooms models.RoomRepository) {
+
+	ctx := context.Background()
+	room := newRoom(t, rooms, false)
+	reader := &repository.User{ID: uuid.New().String(), Name: "reader"}
+	sender := &repository.User{ID: uuid.New().String(), Name: "sender"}
+	if err := rooms.AddRoomMember(ctx, room.GetID(), reader.GetID(), models.RoleMember); err != nil {
+		t.Fatal(err)
+	}
+
+	// Postgres keeps microseconds
+	start := time.Now().UTC().Truncate(time.Millisecond)
+	stored := make([]models.Message, 0)
+	for i := 0; i < 5; i++ {
+		stored = append(stored, newMessage(t, messages, room, sender, start.Add(time.Duration(i)*time.Second)))
+	}
+	own := newMessage(t, messages, room, reader, start.Add(5*time.Second))
+	ids := append(messageIDs(stored), own.GetID())
+
+	found, err := messages.FindMessageByID(ctx, stored[0].GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil ||
+		found.GetTarget().GetID() != room.GetID() ||
+		found.GetSender().GetID() != sender.GetID() ||
+		!found.GetCreatedAt().Equal(start) ||
+		found.GetEditedAt() != nil ||
+		found.GetDeletedAt() != nil {
+		t.Fatalf("FindMessageByID returned %v, want %v", found, stored[0])
+	}
+
+	found, err = messages.FindMessageByID(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != nil {
+		t.Fatalf("FindMessageByID returned %v for an unknown id", found)
+	}
+
+	latest, err := messages.GetRoomMessages(ctx, room.GetID(), "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameIDs(t, "GetRoomMessages", messageIDs(latest), ids[3:])
+
+	older, err := messages.GetRoomMessages(ctx, room.GetID(), latest[0].GetID(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameIDs(t, "GetRoomMessages before", messageIDs(older), ids[:3])
+
+	counts, err := messages.GetUnreadCounts(ctx, reader.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[room.GetID()] != 5 {
+		t.Fatalf("GetUnreadCounts returned %d, want the 5 messages of the sender", counts[room.GetID()])
+	}
+
+	// The cursor only moves forward
+	for _, step := range []struct {
+		message models.Message
+		moved   bool
+	}{
+		{stored[2], true},
+		{stored[1], false},
+		{stored[2], false},
+		{stored[3], true},
+	} {
+		moved, err := messages.MarkRead(ctx, room.GetID(), reader.GetID(), step.message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved != step.moved {
+			t.Fatalf("MarkRead of %s returned %t, want %t", step.message.GetID(), moved, step.moved)
+		}
+	}
+
+	counts, err = messages.GetUnreadCounts(ctx, reader.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[room.GetID()] != 1 {
+		t.Fatalf("GetUnreadCounts returned %d after reading, want 1", counts[room.GetID()])
+	}
+
+	// Changes after since are replayed along with newer messages
+	since := start.Add(4500 * time.Millisecond)
+	edited, err := messages.EditMessage(ctx, stored[0].GetID(), "edited", since.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !edited {
+		t.Fatal("EditMessage returned false for a stored message")
+	}
+	deleted, err := messages.DeleteMessage(ctx, stored[4].GetID(), since.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted {
+		t.Fatal("DeleteMessage returned false for a stored message")
+	}
+
+	missed, err := messages.GetRoomMessagesSince(ctx, room.GetID(), since, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameIDs(t, "GetRoomMessagesSince", messageIDs(missed), []string{ids[0], ids[4], ids[5]})
+	if missed[0].GetMessage() != "edited" || missed[0].GetEditedAt() == nil {
+		t.Fatalf("GetRoomMessagesSince returned %v, want the edited message", missed[0])
+	}
+	if missed[1].GetMessage() != "" || missed[1].GetDeletedAt() == nil {
+		t.Fatalf("GetRoomMessagesSince returned %v, want the deleted message", missed[1])
+	}
+
+	missed, err = messages.GetRoomMessagesSince(ctx, room.GetID(), since, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameIDs(t, "GetRoomMessagesSince limited", messageIDs(missed), []string{ids[4], ids[5]})
+
+	// Deleted messages can't be changed and don't count as unread
+	edited, err = messages.EditMessage(ctx, stored[4].GetID(), "edited", since.Add(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited {
+		t.Fatal("EditMessage returned true for a deleted message")
+	}
+	deleted, err = messages.DeleteMessage(ctx, stored[4].GetID(), since.Add(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted {
+		t.Fatal("DeleteMessage returned true for a deleted message")
+	}
+	counts, err = messages.GetUnreadCounts(ctx, reader.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := counts[room.GetID()]; ok {
+		t.Fatalf("GetUnreadCounts returned %d, want the room left out", counts[room.GetID()])
+	}
+}
+
+// Messages stored at the same time are ordered by id, paging and replay skip none of them
+func testMessagesAtTheSameTime(t *testing.T, messages models.MessageRepository, rooms models.RoomRepository) {
+
+	ctx := context.Background()
+	room := newRoom(t, rooms, false)
+	sender := &repository.User{ID: uuid.New().String(), Name: "sender"}
+
+	createdAt := time.Now().UTC().Truncate(time.Millisecond)
+	ids := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		ids = append(ids, newMessage(t, messages, room, sender, createdAt).GetID())
+	}
+	sort.Strings(ids)
+
+	paged := make([]string, 0)
+	before := ""
+	for i := 0; i < len(ids); i++ {
+		page, err := messages.GetRoomMessages(ctx, room.GetID(), before, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 1 {
+			t.Fatalf("GetRoomMessages returned %d messages before %q, want 1", len(page), before)
+		}
+		before = page[0].GetID()
+		paged = append([]string{before}, paged...)
+	}
+	sameIDs(t, "GetRoomMessages pages", paged, ids)
+
+	missed, err := messages.GetRoomMessagesSince(ctx, room.GetID(), createdAt, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameIDs(t, "GetRoomMessagesSince at the time of the messages", messageIDs(missed), ids)
+}
@@ -1,16 +1,34 @@
 package repository
 
 import (
+	"chat/metrics"
 	"chat/models"
+	"context"
 	"database/sql"
-	"log"
+	"time"
 )
 
+// Invitation ...
+type Invitation struct {
+	Room      *Room
+	InvitedBy *User
+}
+
+// GetRoom returns room the user is invited to
+func (invitation *Invitation) GetRoom() models.Room {
+	return invitation.Room
+}
+
+// GetInvitedBy returns user who sent the invitation
+func (invitation *Invitation) GetInvitedBy() models.User {
+	return invitation.InvitedBy
+}
+
 // Room ...
 type Room struct {
-	ID      string
-	Name    string
-	Private bool
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Private bool   `json:"private"`
 }
 
 // GetID returns id property
@@ -30,30 +48,36 @@ func (room *Room) GetPrivate() bool {
 
 // RoomRepository for db interaction
 type RoomRepository struct {
-	Db *sql.DB
+	Db *DB
 }
 
 // AddRoom adds room into database
-func (repo *RoomRepository) AddRoom(room models.Room) {
+func (repo *RoomRepository) AddRoom(ctx context.Context, room models.Room) error {
+
+	defer metrics.ObserveQuery("AddRoom", time.Now())
 
-	stmt, err := repo.Db.Prepare(
+	stmt, err := repo.Db.PrepareContext(
+		ctx,
 		`INSERT INTO room(id, name, private)
 		 VALUES (?, ?, ?)`,
 	)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer stmt.Close()
 
-	_, err = stmt.Exec(room.GetID(), room.GetName(), room.GetPrivate())
-	if err != nil {
-		log.Fatal(err)
-	}
+	_, err = stmt.ExecContext(ctx, room.GetID(), room.GetName(), room.GetPrivate())
+
+	return err
 }
 
-// FindRoomByName finds room by name in database
-func (repo *RoomRepository) FindRoomByName(name string) models.Room {
+// FindRoomByName finds room by name in database, returns nil if there is no such room
+func (repo *RoomRepository) FindRoomByName(ctx context.Context, name string) (models.Room, error) {
 
-	row := repo.Db.QueryRow(
+	defer metrics.ObserveQuery("FindRoomByName", time.Now())
+
+	row := repo.Db.QueryRowContext(
+		ctx,
 		`SELECT id,
 				name,
 				private
@@ -66,10 +90,343 @@ func (repo *RoomRepository) FindRoomByName(name string) models.Room {
 	var room Room
 	if err := row.Scan(&room.ID, &room.Name, &room.Private); err != nil {
 		if err == sql.ErrNoRows {
-			return nil
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &room, nil
+}
+
+// FindRoomByID finds room by id in database, returns nil if there is no such room
+func (repo *RoomRepository) FindRoomByID(ctx context.Context, id string) (models.Room, error) {
+
+	defer metrics.ObserveQuery("FindRoomByID", time.Now())
+
+	row := repo.Db.QueryRowContext(
+		ctx,
+		`SELECT id,
+				name,
+				private
+		 FROM room
+		 WHERE id = ?`,
+		id,
+	)
+
+	var room Room
+	if err := row.Scan(&room.ID, &room.Name, &room.Private); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &room, nil
+}
+
+// AddRoomMember adds user to the room members, adding an existing member is a no-op
+func (repo *RoomRepository) AddRoomMember(ctx context.Context, roomID string, userID string, role string) error {
+
+	defer metrics.ObserveQuery("AddRoomMember", time.Now())
+
+	stmt, err := repo.Db.PrepareContext(
+		ctx,
+		`INSERT INTO room_member(room_id, user_id, role)
+		 VALUES (?, ?, ?)
+		 ON CONFLICT DO NOTHING`,
+	)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, roomID, userID, role)
+
+	return err
+}
+
+// RemoveRoomMember removes user from the room members
+func (repo *RoomRepository) RemoveRoomMember(ctx context.Context, roomID string, userID string) error {
+
+	defer metrics.ObserveQuery("RemoveRoomMember", time.Now())
+
+	stmt, err := repo.Db.PrepareContext(
+		ctx,
+		`DELETE
+		 FROM room_member
+		 WHERE room_id = ? AND user_id = ?`,
+	)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, roomID, userID)
+
+	return err
+}
+
+// IsRoomMember returns true if user is a member of the room
+func (repo *RoomRepository) IsRoomMember(ctx context.Context, roomID string, userID string) (bool, error) {
+
+	defer metrics.ObserveQuery("IsRoomMember", time.Now())
+
+	row := repo.Db.QueryRowContext(
+		ctx,
+		`SELECT COUNT(*)
+		 FROM room_member
+		 WHERE room_id = ? AND user_id = ?`,
+		roomID,
+		userID,
+	)
+
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// GetRoomMemberRole returns role of the user in the room, or empty string if the user is not a member
+func (repo *RoomRepository) GetRoomMemberRole(ctx context.Context, roomID string, userID string) (string, error) {
+
+	defer metrics.ObserveQuery("GetRoomMemberRole", time.Now())
+
+	row := repo.Db.QueryRowContext(
+		ctx,
+		`SELECT role
+		 FROM room_member
+		 WHERE room_id = ? AND user_id = ?`,
+		roomID,
+		userID,
+	)
+
+	var role string
+	if err := row.Scan(&role); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return role, nil
+}
+
+// SetRoomMemberRole changes the role of the user in the room, returns false if the user is not a member
+func (repo *RoomRepository) SetRoomMemberRole(ctx context.Context, roomID string, userID string, role string) (bool, error) {
+
+	defer metrics.ObserveQuery("SetRoomMemberRole", time.Now())
+
+	stmt, err := repo.Db.PrepareContext(
+		ctx,
+		`UPDATE room_member
+		 SET role = ?
+		 WHERE room_id = ? AND user_id = ?`,
+	)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, role, roomID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	changed, err := result.RowsAffected()
+
+	return changed > 0, err
+}
+
+// AddRoomInvitation stores invitation of user to the room, inviting again is a no-op
+func (repo *RoomRepository) AddRoomInvitation(ctx context.Context, roomID string, userID string, invitedBy string) error {
+
+	defer metrics.ObserveQuery("AddRoomInvitation", time.Now())
+
+	stmt, err := repo.Db.PrepareContext(
+		ctx,
+		`INSERT INTO room_invitation(room_id, user_id, invited_by)
+		 VALUES (?, ?, ?)
+		 ON CONFLICT DO NOTHING`,
+	)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, roomID, userID, invitedBy)
+
+	return err
+}
+
+// RemoveRoomInvitation removes invitation of user to the room, returns false if there was none
+func (repo *RoomRepository) RemoveRoomInvitation(ctx context.Context, roomID string, userID string) (bool, error) {
+
+	defer metrics.ObserveQuery("RemoveRoomInvitation", time.Now())
+
+	stmt, err := repo.Db.PrepareContext(
+		ctx,
+		`DELETE
+		 FROM room_invitation
+		 WHERE room_id = ? AND user_id = ?`,
+	)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, roomID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	removed, err := result.RowsAffected()
+
+	return removed > 0, err
+}
+
+// GetUserInvitations gets pending invitations of the user
+func (repo *RoomRepository) GetUserInvitations(ctx context.Context, userID string) ([]models.Invitation, error) {
+
+	defer metrics.ObserveQuery("GetUserInvitations", time.Now())
+
+	rows, err := repo.Db.QueryContext(
+		ctx,
+		`SELECT r.id,
+				r.name,
+				r.private,
+				a.id,
+				a.name
+		 FROM room_invitation i
+		 JOIN room r ON r.id = i.room_id
+		 JOIN account a ON a.id = i.invited_by
+		 WHERE i.user_id = ?`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var invitations []models.Invitation
+	defer rows.Close()
+
+	for rows.Next() {
+		invitation := Invitation{
+			Room:      &Room{},
+			InvitedBy: &User{},
+		}
+		err = rows.Scan(
+			&invitation.Room.ID,
+			&invitation.Room.Name,
+			&invitation.Room.Private,
+			&invitation.InvitedBy.ID,
+			&invitation.InvitedBy.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, &invitation)
+	}
+
+	return invitations, rows.Err()
+}
+
+// GetPublicRooms gets all public rooms from database
+func (repo *RoomRepository) GetPublicRooms(ctx context.Context) ([]models.Room, error) {
+
+	defer metrics.ObserveQuery("GetPublicRooms", time.Now())
+
+	rows, err := repo.Db.QueryContext(
+		ctx,
+		`SELECT id,
+				name,
+				private
+		 FROM room
+		 WHERE NOT private
+		 ORDER BY name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := make([]models.Room, 0)
+	defer rows.Close()
+
+	for rows.Next() {
+		var room Room
+		if err = rows.Scan(&room.ID, &room.Name, &room.Private); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, &room)
+	}
+
+	return rooms, rows.Err()
+}
+
+// GetUserRooms gets all rooms the user is a member of
+func (repo *RoomRepository) GetUserRooms(ctx context.Context, userID string) ([]models.Room, error) {
+
+	defer metrics.ObserveQuery("GetUserRooms", time.Now())
+
+	rows, err := repo.Db.QueryContext(
+		ctx,
+		`SELECT r.id,
+				r.name,
+				r.private
+		 FROM room_member m
+		 JOIN room r ON r.id = m.room_id
+		 WHERE m.user_id = ?
+		 ORDER BY r.name`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := make([]models.Room, 0)
+	defer rows.Close()
+
+	for rows.Next() {
+		var room Room
+		if err = rows.Scan(&room.ID, &room.Name, &room.Private); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, &room)
+	}
+
+	return rooms, rows.Err()
+}
+
+// GetRoomMembers gets all members of the room
+func (repo *RoomRepository) GetRoomMembers(ctx context.Context, roomID string) ([]models.User, error) {
+
+	defer metrics.ObserveQuery("GetRoomMembers", time.Now())
+
+	rows, err := repo.Db.QueryContext(
+		ctx,
+		`SELECT a.id,
+				a.name
+		 FROM room_member m
+		 JOIN account a ON a.id = m.user_id
+		 WHERE m.room_id = ?
+		 ORDER BY a.name`,
+		roomID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]models.User, 0)
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		if err = rows.Scan(&user.ID, &user.Name); err != nil {
+			return nil, err
 		}
-		log.Fatal(err)
+		users = append(users, &user)
 	}
 
-	return &room
+	return users, rows.Err()
 }
@@ -0,0 +1,17 @@
+package repository
+
+// User ...
+type User struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// GetID ...
+func (user *User) GetID() string {
+	return user.ID
+}
+
+// GetName ...
+func (user *User) GetName() string {
+	return user.Name
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"chat/session"
+)
+
+// Tells the client the token to resume this connection with after it drops
+func (client *Client) sendSession() {
+
+	message := &Message{
+		Action:  SessionAction,
+		Message: client.sessionToken,
+	}
+
+	client.sendMessage(message)
+}
+
+// Keeps the session of the dropped connection for the grace period
+func (client *Client) saveSession() {
+
+	gracePeriod := client.wsServer.options.SessionGracePeriod
+	if gracePeriod <= 0 {
+		return
+	}
+
+	dropped := &session.Session{
+		UserID:         client.GetID(),
+		DisconnectedAt: time.Now().UTC(),
+	}
+
+	if err := client.wsServer.sessions.Save(ctx, client.sessionToken, dropped, gracePeriod); err != nil {
+		log.Printf("Error on saving session of user %s: %s", client.GetID(), err)
+	}
+}
+
+// Returns the session of a dropped connection of the same user, the session
+// is gone after this so a token can't be resumed twice
+func (client *Client) takeSession(token string) *session.Session {
+
+	if token == "" || client.wsServer.options.SessionGracePeriod <= 0 {
+		return nil
+	}
+
+	dropped, err := client.wsServer.sessions.Take(ctx, token)
+	if err != nil {
+		log.Printf("Error on loading session of user %s: %s", client.GetID(), err)
+		client.sendError("", ErrorCodeInternal, "could not resume session")
+		return nil
+	}
+
+	// Tokens of other users are treated as unknown
+	if dropped == nil || dropped.UserID != client.GetID() {
+		client.sendError("", ErrorCodeNoSession, "session expired")
+		return nil
+	}
+
+	return dropped
+}
+
+// Returns the time since which the resumed client missed messages, that
+// is the last message it received or else when the connection dropped
+func (client *Client) missedSince(dropped *session.Session, lastMessageID string) time.Time {
+
+	if lastMessageID == "" {
+		return dropped.DisconnectedAt
+	}
+
+	lastMessage, err := client.wsServer.messageRepository.FindMessageByID(ctx, lastMessageID)
+	if err != nil {
+		log.Printf("Error on finding message %s: %s", lastMessageID, err)
+		return dropped.DisconnectedAt
+	}
+	if lastMessage == nil {
+		return dropped.DisconnectedAt
+	}
+
+	return lastMessage.GetCreatedAt()
+}
@@ -0,0 +1,54 @@
+package main
+
+import "chat/models"
+
+// The creator of a room owns it. Owners appoint moderators among the members
+// and may demote them again, moderators edit and delete messages of others.
+
+// Makes the member with ID in the message text a moderator of the target room
+func (client *Client) handlePromoteMemberMessage(message Message) {
+	client.setMemberRole(message, models.RoleModerator)
+}
+
+// Makes the moderator with ID in the message text a plain member of the target room again
+func (client *Client) handleDemoteMemberMessage(message Message) {
+	client.setMemberRole(message, models.RoleMember)
+}
+
+func (client *Client) setMemberRole(message Message, role string) {
+
+	room, ok := client.findTargetRoom(message)
+	if !ok {
+		return
+	}
+
+	ownRole, err := client.wsServer.roomRepository.GetRoomMemberRole(ctx, room.GetID(), client.GetID())
+	if err != nil {
+		client.sendGroupError(message.RequestID, "could not change role", err)
+		return
+	}
+
+	if ownRole != models.RoleOwner {
+		client.sendError(message.RequestID, ErrorCodeForbidden, "only the room owner can change roles")
+		return
+	}
+
+	// A room without owner could never get moderators again
+	if message.Message == client.GetID() {
+		client.sendError(message.RequestID, ErrorCodeForbidden, "the owner's role can't be changed")
+		return
+	}
+
+	changed, err := client.wsServer.roomRepository.SetRoomMemberRole(ctx, room.GetID(), message.Message, role)
+	if err != nil {
+		client.sendGroupError(message.RequestID, "could not change role", err)
+		return
+	}
+
+	if !changed {
+		client.sendError(message.RequestID, ErrorCodeNotAMember, "user is not a member of the room")
+		return
+	}
+
+	client.sendAck(message.RequestID)
+}
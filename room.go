@@ -1,10 +1,14 @@
 package main
 
 import (
-	"chat/config"
+	"bytes"
+	"chat/metrics"
+	"chat/pubsub"
 	"context"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -15,17 +19,28 @@ var ctx = context.Background()
 
 // Room ...
 type Room struct {
-	ID         uuid.UUID `json:"id"`
-	Name       string    `json:"name"`
-	Private    bool      `json:"private"`
-	clients    map[*Client]bool
-	register   chan *Client
-	unregister chan *Client
-	broadcast  chan *Message
+	ID      uuid.UUID `json:"id"`
+	Name    string    `json:"name"`
+	Private bool      `json:"private"`
+	clients map[*Client]bool
+	// Guards clients, written by the room loop and read by the pub/sub consumer
+	clientsLock sync.RWMutex
+	register    chan *Client
+	unregister  chan *Client
+	broadcast   chan *Message
+	typing      chan *Message
+	quit        chan struct{}
+	stopOnce    sync.Once
+	pubSub      pubsub.PubSub
+	// Users typing in the room by user id, only touched by the room loop
+	typists map[string]*typist
+
+	// The room stops itself after being empty for this long, zero keeps it running
+	idleTimeout time.Duration
 }
 
 // NewRoom creates a new room
-func NewRoom(name string, private bool) *Room {
+func NewRoom(name string, private bool, pubSub pubsub.PubSub) *Room {
 	return &Room{
 		ID:         uuid.New(),
 		Name:       name,
@@ -34,62 +49,154 @@ func NewRoom(name string, private bool) *Room {
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		broadcast:  make(chan *Message),
+		typing:     make(chan *Message),
+		quit:       make(chan struct{}),
+		pubSub:     pubSub,
+		typists:    make(map[string]*typist),
 	}
 }
 
-// RunRoom runs our room, accepting various requests
+// RunRoom runs our room, accepting various requests until stopped or idle
 func (room *Room) RunRoom() {
 
-	// subscribe to pub/sub messages inside a new goroutine
-	go room.subscribeToRoomMessages()
+	// subscribe before accepting clients so no published message is missed,
+	// then consume pub/sub messages inside a new goroutine
+	subscription, err := room.pubSub.Subscribe(ctx, room.GetName())
+	if err != nil {
+		log.Printf("Error on subscribing to room %s: %s", room.GetName(), err)
+	} else {
+		go room.subscribeToRoomMessages(subscription)
+		defer subscription.Unsubscribe()
+	}
+
+	// A freshly loaded room is empty, so the idle countdown starts right away
+	var idleTimer *time.Timer
+	var idle <-chan time.Time
+	if room.idleTimeout > 0 {
+		idleTimer = time.NewTimer(room.idleTimeout)
+		idle = idleTimer.C
+	}
+
+	// Ticks only while someone is typing
+	var typingTicker *time.Ticker
+	var typingTick <-chan time.Time
+	defer func() {
+		if typingTicker != nil {
+			typingTicker.Stop()
+		}
+	}()
 
 	for {
 		select {
 
 		case client := <-room.register:
 			room.registerClientInRoom(client)
+			if idleTimer != nil {
+				idleTimer.Stop()
+				idle = nil
+			}
 
 		case client := <-room.unregister:
 			room.unregisterClientInRoom(client)
+			if len(room.clients) == 0 && room.idleTimeout > 0 {
+				idleTimer = time.NewTimer(room.idleTimeout)
+				idle = idleTimer.C
+			}
 
 		case message := <-room.broadcast:
-			room.publishRoomMessage(message.encode())
+			// Members stop showing the sender as typing once its message arrives
+			delete(room.typists, message.Sender.GetID())
+			room.publishRoomMessage(message)
+
+		case message := <-room.typing:
+			room.handleTyping(message)
+			if typingTicker == nil && len(room.typists) > 0 {
+				typingTicker = time.NewTicker(time.Second)
+				typingTick = typingTicker.C
+			}
+
+		case <-typingTick:
+			room.expireTyping()
+			if len(room.typists) == 0 {
+				typingTicker.Stop()
+				typingTicker, typingTick = nil, nil
+			}
+
+		case <-idle:
+			// Registrations are only accepted by this loop, so once stopped
+			// here no client can end up in a dead room
+			room.Stop()
+			return
+
+		case <-room.quit:
+			return
 		}
 	}
 }
 
-func (room *Room) registerClientInRoom(client *Client) {
+// Stop stops the room loop and its pub/sub subscription
+func (room *Room) Stop() {
+	room.stopOnce.Do(func() {
+		close(room.quit)
+	})
+}
 
-	// by sending the message first the new user won't see his own message.
-	if !room.Private {
-		room.notifyClientJoined(client)
+// Stopped returns true once the room stopped, stopped rooms are reloaded on demand
+func (room *Room) Stopped() bool {
+	select {
+	case <-room.quit:
+		return true
+	default:
+		return false
 	}
+}
+
+func (room *Room) registerClientInRoom(client *Client) {
+
+	room.clientsLock.Lock()
+	defer room.clientsLock.Unlock()
 
 	room.clients[client] = true
 }
 
 func (room *Room) unregisterClientInRoom(client *Client) {
 
+	room.clientsLock.Lock()
+	defer room.clientsLock.Unlock()
+
 	if _, ok := room.clients[client]; ok {
 		delete(room.clients, client)
 	}
 }
 
-func (room *Room) broadCastToClientsInRoom(message []byte) {
+// enqueue never blocks, so the lock is held only briefly
+func (room *Room) broadCastToClientsInRoom(action string, message []byte) {
+
+	room.clientsLock.RLock()
+	defer room.clientsLock.RUnlock()
+
+	metrics.MessagesSent.WithLabelValues(action).Add(float64(len(room.clients)))
 	for client := range room.clients {
-		client.send <- message
+		client.enqueue(message)
 	}
 }
 
+// Announces a new member of a public room, sent before the member
+// is registered so it won't see its own message
 func (room *Room) notifyClientJoined(client *Client) {
 
+	if room.Private {
+		return
+	}
+
 	message := &Message{
 		Action:  SendMessageAction,
 		Target:  room,
 		Message: fmt.Sprintf(welcomeMessage, client.GetName()),
 	}
+	message.stamp()
 
-	room.publishRoomMessage(message.encode())
+	room.publishRoomMessage(message)
 }
 
 // GetName returns room's name
@@ -107,21 +214,33 @@ func (room *Room) GetPrivate() bool {
 	return room.Private
 }
 
-func (room *Room) publishRoomMessage(message []byte) {
+// Room channel payloads carry the action on a line ahead of the encoded message,
+// so receivers label the metrics without decoding every message
+func (room *Room) publishRoomMessage(message *Message) {
 
-	err := config.Redis.Publish(ctx, room.GetName(), message).Err()
+	payload := append([]byte(message.Action+"\n"), message.encode()...)
+	err := room.pubSub.Publish(ctx, room.GetName(), payload)
 
 	if err != nil {
 		log.Println(err)
 	}
 }
 
-func (room *Room) subscribeToRoomMessages() {
+func (room *Room) subscribeToRoomMessages(subscription pubsub.Subscription) {
 
-	pubSub := config.Redis.Subscribe(ctx, room.GetName())
-	ch := pubSub.Channel()
+	for payload := range subscription.Channel() {
+		action, message := splitRoomPayload(payload)
+		room.broadCastToClientsInRoom(action, message)
+	}
+}
 
-	for msg := range ch {
-		room.broadCastToClientsInRoom([]byte(msg.Payload))
+// Encoded json has no raw newlines, so the first one ends the action
+func splitRoomPayload(payload []byte) (string, []byte) {
+
+	i := bytes.IndexByte(payload, '\n')
+	if i < 0 {
+		return "", payload
 	}
+
+	return string(payload[:i]), payload[i+1:]
 }
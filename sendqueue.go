@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"chat/metrics"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowConsumerPolicy decides what happens to a message when the send queue of a client is full
+type SlowConsumerPolicy string
+
+const (
+	// DropOldest discards the oldest queued message to make room for the new one
+	DropOldest SlowConsumerPolicy = "drop-oldest"
+	// DropMessage discards the new message
+	DropMessage SlowConsumerPolicy = "drop-message"
+	// Disconnect closes the connection of the slow client
+	Disconnect SlowConsumerPolicy = "disconnect"
+)
+
+// Close reason sent to clients disconnected for not keeping up
+const slowConsumerCloseReason = "too slow to keep up"
+
+// ParseSlowConsumerPolicy checks the policy name
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+
+	switch policy := SlowConsumerPolicy(name); policy {
+	case DropOldest, DropMessage, Disconnect:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("unknown slow consumer policy %q", name)
+}
+
+// SendQueueStats counts how often each slow consumer policy fired
+type SendQueueStats struct {
+	DroppedOldest int64 `json:"droppedOldest"`
+	DroppedNew    int64 `json:"droppedNew"`
+	Disconnected  int64 `json:"disconnected"`
+}
+
+var sendQueueStats SendQueueStats
+
+// GetSendQueueStats returns a snapshot of the slow consumer counters
+func GetSendQueueStats() SendQueueStats {
+	return SendQueueStats{
+		DroppedOldest: atomic.LoadInt64(&sendQueueStats.DroppedOldest),
+		DroppedNew:    atomic.LoadInt64(&sendQueueStats.DroppedNew),
+		Disconnected:  atomic.LoadInt64(&sendQueueStats.Disconnected),
+	}
+}
+
+func init() {
+	metrics.NewCounterFunc("send_queue_dropped_oldest_total", "Queued messages dropped for newer ones.", func() float64 {
+		return float64(atomic.LoadInt64(&sendQueueStats.DroppedOldest))
+	})
+	metrics.NewCounterFunc("send_queue_dropped_total", "New messages dropped because the send queue was full.", func() float64 {
+		return float64(atomic.LoadInt64(&sendQueueStats.DroppedNew))
+	})
+	metrics.NewCounterFunc("slow_consumer_disconnects_total", "Clients disconnected for not keeping up.", func() float64 {
+		return float64(atomic.LoadInt64(&sendQueueStats.Disconnected))
+	})
+}
+
+// sendMessage encodes and queues a message for the client
+func (client *Client) sendMessage(message *Message) {
+	metrics.MessagesSent.WithLabelValues(message.Action).Inc()
+	client.enqueue(message.encode())
+}
+
+// sendWaiting queues a message of the history for the client, waiting for room
+// in the queue instead of applying the slow consumer policy, which guards rooms
+// and the server loop against live traffic. Returns false once the client is gone
+// or didn't take the message within the write wait, the rest of the history is skipped then.
+func (client *Client) sendWaiting(message *Message) bool {
+	metrics.MessagesSent.WithLabelValues(message.Action).Inc()
+
+	timer := time.NewTimer(client.wsServer.options.Websocket.WriteWait)
+	defer timer.Stop()
+
+	select {
+	case client.send <- message.encode():
+		return true
+	case <-client.done:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+// enqueue never blocks the caller, so one stalled client can't hold up
+// a room or the server loop. A full queue is handled by the server policy.
+func (client *Client) enqueue(message []byte) {
+
+	select {
+	case client.send <- message:
+		return
+	case <-client.done:
+		return
+	default:
+	}
+
+	switch client.wsServer.options.SlowConsumerPolicy {
+	case DropOldest:
+		// Other goroutines may refill the queue in between, then the new message is dropped
+		select {
+		case <-client.send:
+			atomic.AddInt64(&sendQueueStats.DroppedOldest, 1)
+		default:
+		}
+		select {
+		case client.send <- message:
+		default:
+			atomic.AddInt64(&sendQueueStats.DroppedNew, 1)
+		}
+
+	case Disconnect:
+		client.kickOnce.Do(func() {
+			atomic.AddInt64(&sendQueueStats.Disconnected, 1)
+			// Writing the close frame may block on the stalled connection
+			go client.close(websocket.CloseTryAgainLater, slowConsumerCloseReason)
+		})
+
+	default:
+		atomic.AddInt64(&sendQueueStats.DroppedNew, 1)
+	}
+}
@@ -0,0 +1,61 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory in-process session store, for running a single node without redis
+type Memory struct {
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+}
+
+type memorySession struct {
+	session   *Session
+	expiresAt time.Time
+}
+
+// NewMemory creates in-process session store
+func NewMemory() *Memory {
+	return &Memory{sessions: make(map[string]*memorySession)}
+}
+
+// Save stores the session until ttl passes
+func (store *Memory) Save(ctx context.Context, token string, session *Session, ttl time.Duration) error {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// Drop expired sessions on the way, nobody else removes them
+	now := time.Now()
+	for token, stored := range store.sessions {
+		if !stored.expiresAt.After(now) {
+			delete(store.sessions, token)
+		}
+	}
+
+	store.sessions[token] = &memorySession{session: session, expiresAt: now.Add(ttl)}
+
+	return nil
+}
+
+// Take returns and removes the session
+func (store *Memory) Take(ctx context.Context, token string) (*Session, error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.sessions[token]
+	if !ok {
+		return nil, nil
+	}
+	delete(store.sessions, token)
+
+	if !stored.expiresAt.After(time.Now()) {
+		return nil, nil
+	}
+
+	return stored.session, nil
+}
@@ -0,0 +1,57 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Session key prefix, followed by the token
+const keyPrefix = "session:"
+
+// Redis session store shared by all chat nodes
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis creates redis backed session store
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{client: client}
+}
+
+// Save stores the session until ttl passes
+func (store *Redis) Save(ctx context.Context, token string, session *Session, ttl time.Duration) error {
+
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	return store.client.Set(ctx, keyPrefix+token, encoded, ttl).Err()
+}
+
+// Take returns and removes the session
+func (store *Redis) Take(ctx context.Context, token string) (*Session, error) {
+
+	var get *redis.StringCmd
+	_, err := store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, keyPrefix+token)
+		pipe.Del(ctx, keyPrefix+token)
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal([]byte(get.Val()), &session); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
@@ -0,0 +1,34 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+)
+
+// Session is what a client needs to pick up where its dropped connection left off
+type Session struct {
+	UserID         string    `json:"userId"`
+	DisconnectedAt time.Time `json:"disconnectedAt"`
+}
+
+// Store keeps sessions of dropped connections for a grace period, shared by
+// all nodes as the client may reconnect to any of them
+type Store interface {
+	Save(ctx context.Context, token string, session *Session, ttl time.Duration) error
+	// Take returns and removes the session, so it can only be resumed once.
+	// Returns nil if there is no such session or it expired.
+	Take(ctx context.Context, token string) (*Session, error)
+}
+
+// NewToken returns a random session token
+func NewToken() (string, error) {
+
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+
+	"chat/models"
+)
+
+// A typing user is announced at most once per interval, which also
+// refreshes the indicator for members who entered the room meanwhile
+const typingRelayInterval = 3 * time.Second
+
+// Typing stops when the user sent nothing for this long
+const typingTimeout = 5 * time.Second
+
+// Text of typing messages relayed to room members
+const (
+	TypingStarted = "started"
+	TypingStopped = "stopped"
+)
+
+// Typing state of a user in a room
+type typist struct {
+	user        models.User
+	announcedAt time.Time
+	expiresAt   time.Time
+}
+
+// Relays typing of the client to the members of the room in the message target,
+// the client may end it early by sending the stopped text
+func (client *Client) handleTypingMessage(message Message) {
+
+	if message.Target == nil {
+		client.sendError(message.RequestID, ErrorCodeRoomNotFound, "room not found")
+		return
+	}
+
+	// Typing is sent often, so only rooms entered on this connection are looked at
+	room := client.findRoom(message.Target.GetID())
+	if room == nil {
+		client.sendError(message.RequestID, ErrorCodeNotAMember, "not a member of the room")
+		return
+	}
+
+	typing := &Message{
+		Action:  TypingAction,
+		Message: TypingStarted,
+		Target:  room,
+		Sender:  client,
+	}
+	if message.Message == TypingStopped {
+		typing.Message = TypingStopped
+	}
+
+	// Typing is not worth reloading a stopped room for
+	select {
+	case room.typing <- typing:
+		client.sendAck(message.RequestID)
+	case <-room.quit:
+	}
+}
+
+// Called by the room loop for typing messages of its clients
+func (room *Room) handleTyping(message *Message) {
+
+	now := time.Now()
+	userID := message.Sender.GetID()
+	current, ok := room.typists[userID]
+
+	if message.Message == TypingStopped {
+		if ok {
+			delete(room.typists, userID)
+			room.publishRoomMessage(message)
+		}
+		return
+	}
+
+	if !ok {
+		current = &typist{user: message.Sender}
+		room.typists[userID] = current
+	}
+	current.expiresAt = now.Add(typingTimeout)
+
+	if now.Sub(current.announcedAt) >= typingRelayInterval {
+		current.announcedAt = now
+		room.publishRoomMessage(message)
+	}
+}
+
+// Called by the room loop to stop users who went quiet
+func (room *Room) expireTyping() {
+
+	now := time.Now()
+	for userID, current := range room.typists {
+		if now.Before(current.expiresAt) {
+			continue
+		}
+
+		delete(room.typists, userID)
+		stopped := &Message{
+			Action:  TypingAction,
+			Message: TypingStopped,
+			Target:  room,
+			Sender:  current.user,
+		}
+		room.publishRoomMessage(stopped)
+	}
+}